@@ -0,0 +1,76 @@
+// Copyright © 2024 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/cerc-io/ipld-eth-state-snapshot/pkg/snapshot"
+)
+
+// blockRangeCmd represents the blockRange command
+var blockRangeCmd = &cobra.Command{
+	Use:   "blockRange",
+	Short: "Extract block data (headers, transactions, receipts, logs, uncles, withdrawals) for a range of blocks from Ethdb and publish into PG-IPFS",
+	Long: `Usage
+
+./ipld-eth-state-snapshot blockRange --config={path to toml config file} --start-height={N} --end-height={M}`,
+	Run: func(cmd *cobra.Command, args []string) {
+		subCommand = cmd.CalledAs()
+		logWithCommand = *logrus.WithField("SubCommand", subCommand)
+		blockRange()
+	},
+}
+
+func blockRange() {
+	mode := snapshot.SnapshotMode(viper.GetString(snapshot.SNAPSHOT_MODE_TOML))
+	config, err := snapshot.NewConfig(mode)
+	if err != nil {
+		logWithCommand.Fatalf("unable to initialize config: %v", err)
+	}
+	edb := openEthDB(config)
+	if _, err := snapshot.ReadChainConfig(edb); err != nil {
+		logWithCommand.Fatal(err)
+	}
+	indexer := newIndexer(config, edb, mode, false)
+
+	service, err := snapshot.NewSnapshotService(edb, indexer, "")
+	if err != nil {
+		logWithCommand.Fatal(err)
+	}
+	ctx, cancel := signalContext()
+	defer cancel()
+	params := snapshot.BlockRangeParams{
+		Start: viper.GetUint64(snapshot.BLOCKS_START_HEIGHT_TOML),
+		End:   viper.GetUint64(snapshot.BLOCKS_END_HEIGHT_TOML),
+	}
+	if err := service.IndexBlocks(ctx, params); err != nil {
+		logWithCommand.Fatal(err)
+	}
+	logWithCommand.Infof("Block data for blocks %d to %d is complete", params.Start, params.End)
+}
+
+func init() {
+	rootCmd.AddCommand(blockRangeCmd)
+
+	blockRangeCmd.PersistentFlags().Uint64(snapshot.BLOCKS_START_HEIGHT_CLI, 0, "first block height to index")
+	blockRangeCmd.PersistentFlags().Uint64(snapshot.BLOCKS_END_HEIGHT_CLI, 0, "last block height to index")
+
+	viper.BindPFlag(snapshot.BLOCKS_START_HEIGHT_TOML, blockRangeCmd.PersistentFlags().Lookup(snapshot.BLOCKS_START_HEIGHT_CLI))
+	viper.BindPFlag(snapshot.BLOCKS_END_HEIGHT_TOML, blockRangeCmd.PersistentFlags().Lookup(snapshot.BLOCKS_END_HEIGHT_CLI))
+}
@@ -17,10 +17,15 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 
+	"github.com/cerc-io/plugeth-statediff/indexer"
+	"github.com/ethereum/go-ethereum/ethdb"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -116,6 +121,17 @@ func init() {
 	rootCmd.PersistentFlags().String(snapshot.PROM_HTTP_PORT_CLI, "8086", "prometheus http port")
 	rootCmd.PersistentFlags().Bool(snapshot.PROM_DB_STATS_CLI, false, "enables prometheus db stats")
 
+	rootCmd.PersistentFlags().String(snapshot.ETHDB_PATH_CLI, "", "path to primary datastore")
+	rootCmd.PersistentFlags().String(snapshot.ETHDB_ANCIENT_CLI, "", "path to ancient datastore")
+	rootCmd.PersistentFlags().Int(snapshot.SNAPSHOT_WORKERS_CLI, 1, "number of concurrent workers to use")
+	rootCmd.PersistentFlags().Uint(snapshot.SNAPSHOT_BATCH_SIZE_CLI, 100, "number of records to write to the indexer at a time")
+	rootCmd.PersistentFlags().Uint(snapshot.SNAPSHOT_BATCH_BYTES_CLI, 0, "approximate size in bytes at which records are written to the indexer (0 for no limit)")
+	rootCmd.PersistentFlags().Uint(snapshot.SNAPSHOT_WRITERS_CLI, 0, "number of goroutines writing to the indexer (0 for one per worker)")
+	rootCmd.PersistentFlags().Uint(snapshot.SNAPSHOT_QUEUE_LENGTH_CLI, 1024, "number of records which may be queued for each writer")
+	rootCmd.PersistentFlags().String(snapshot.SNAPSHOT_MODE_CLI, "postgres", "output mode for snapshot ('file' or 'postgres')")
+	rootCmd.PersistentFlags().String(snapshot.FILE_OUTPUT_DIR_CLI, "", "directory for writing ouput to while operating in 'file' mode")
+	rootCmd.PersistentFlags().StringArray(snapshot.SNAPSHOT_ACCOUNTS_CLI, nil, "list of account addresses to limit snapshot to")
+
 	viper.BindPFlag(snapshot.LOG_FILE_TOML, rootCmd.PersistentFlags().Lookup(snapshot.LOG_FILE_CLI))
 	viper.BindPFlag(snapshot.DATABASE_NAME_TOML, rootCmd.PersistentFlags().Lookup(snapshot.DATABASE_NAME_CLI))
 	viper.BindPFlag(snapshot.DATABASE_PORT_TOML, rootCmd.PersistentFlags().Lookup(snapshot.DATABASE_PORT_CLI))
@@ -129,6 +145,94 @@ func init() {
 	viper.BindPFlag(snapshot.PROM_HTTP_ADDR_TOML, rootCmd.PersistentFlags().Lookup(snapshot.PROM_HTTP_ADDR_CLI))
 	viper.BindPFlag(snapshot.PROM_HTTP_PORT_TOML, rootCmd.PersistentFlags().Lookup(snapshot.PROM_HTTP_PORT_CLI))
 	viper.BindPFlag(snapshot.PROM_DB_STATS_TOML, rootCmd.PersistentFlags().Lookup(snapshot.PROM_DB_STATS_CLI))
+
+	viper.BindPFlag(snapshot.ETHDB_PATH_TOML, rootCmd.PersistentFlags().Lookup(snapshot.ETHDB_PATH_CLI))
+	viper.BindPFlag(snapshot.ETHDB_ANCIENT_TOML, rootCmd.PersistentFlags().Lookup(snapshot.ETHDB_ANCIENT_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_WORKERS_TOML, rootCmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_WORKERS_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_BATCH_SIZE_TOML, rootCmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_BATCH_SIZE_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_BATCH_BYTES_TOML, rootCmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_BATCH_BYTES_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_WRITERS_TOML, rootCmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_WRITERS_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_QUEUE_LENGTH_TOML, rootCmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_QUEUE_LENGTH_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_MODE_TOML, rootCmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_MODE_CLI))
+	viper.BindPFlag(snapshot.FILE_OUTPUT_DIR_TOML, rootCmd.PersistentFlags().Lookup(snapshot.FILE_OUTPUT_DIR_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_ACCOUNTS_TOML, rootCmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_ACCOUNTS_CLI))
+}
+
+// openEthDB opens the configured ethdb, exiting on failure.
+func openEthDB(config *snapshot.Config) ethdb.Database {
+	logWithCommand.Infof("opening ethdb and ancient data at %s and %s",
+		config.Eth.DBPath, config.Eth.AncientDBPath)
+	edb, err := snapshot.NewEthDB(config.Eth)
+	if err != nil {
+		logWithCommand.Fatal(err)
+	}
+	return edb
+}
+
+// setBatchSize applies the configured batch size and writers to the service.
+func setBatchSize(service *snapshot.Service) {
+	service.SetBatchSize(
+		viper.GetUint(snapshot.SNAPSHOT_BATCH_SIZE_TOML),
+		viper.GetUint(snapshot.SNAPSHOT_BATCH_BYTES_TOML),
+	)
+	service.SetWriters(
+		viper.GetUint(snapshot.SNAPSHOT_WRITERS_TOML),
+		viper.GetUint(snapshot.SNAPSHOT_QUEUE_LENGTH_TOML),
+	)
+}
+
+// signalContext returns a context which is cancelled on SIGINT or SIGTERM. On cancellation, the
+// snapshot workers complete processing of their current node before stopping.
+func signalContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		defer signal.Stop(sigChan)
+		select {
+		case sig := <-sigChan:
+			log.Errorf("Signal received (%v), stopping", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// newIndexer creates an indexer for the configured output mode, exiting on failure. isDiff marks
+// the output as incremental diffs rather than full snapshots.
+func newIndexer(config *snapshot.Config, edb ethdb.Database, mode snapshot.SnapshotMode, isDiff bool) indexer.Indexer {
+	// the chain config is only needed to index block data, so state can be indexed without it
+	chainConfig, err := snapshot.ReadChainConfig(edb)
+	if err != nil {
+		logWithCommand.Warnf("block data cannot be indexed: %v", err)
+	}
+	var idxconfig indexer.Config
+	switch mode {
+	case snapshot.PgSnapshot:
+		idxconfig = *config.DB
+	case snapshot.FileSnapshot:
+		idxconfig = *config.File
+	}
+	db, indexer, err := indexer.NewStateDiffIndexer(
+		context.Background(),
+		chainConfig,
+		config.Eth.NodeInfo,
+		idxconfig,
+		isDiff,
+	)
+	if err != nil {
+		logWithCommand.Fatal(err)
+	}
+	if db == nil {
+		return indexer
+	}
+	// the postgres indexer is extended to write storage nodes apart from their account
+	pgIndexer, err := snapshot.NewPgIndexer(context.Background(), chainConfig, db, isDiff)
+	if err != nil {
+		logWithCommand.Fatal(err)
+	}
+	return pgIndexer
 }
 
 func initConfig() {
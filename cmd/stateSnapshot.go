@@ -17,14 +17,23 @@ package cmd
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/cerc-io/plugeth-statediff/indexer/database/sql/postgres"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/jmoiron/sqlx"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 
 	"github.com/cerc-io/ipld-eth-state-snapshot/pkg/snapshot"
-	"github.com/cerc-io/plugeth-statediff/indexer"
 )
 
 // stateSnapshotCmd represents the stateSnapshot command
@@ -37,6 +46,7 @@ var stateSnapshotCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		subCommand = cmd.CalledAs()
 		logWithCommand = *logrus.WithField("SubCommand", subCommand)
+		bindSelectionFlags(cmd)
 		stateSnapshot()
 	},
 }
@@ -47,73 +57,413 @@ func stateSnapshot() {
 	if err != nil {
 		logWithCommand.Fatalf("unable to initialize config: %v", err)
 	}
-	logWithCommand.Infof("opening ethdb and ancient data at %s and %s",
-		config.Eth.DBPath, config.Eth.AncientDBPath)
-	edb, err := snapshot.NewEthDB(config.Eth)
+	edb := openEthDB(config)
+	height := blockHeight()
+	heights := config.Service.BlockHeights
+	fromHeight := viper.GetInt64(snapshot.SNAPSHOT_FROM_HEIGHT_TOML)
+	delta := fromHeight >= 0
+	if delta && (height < 0 || len(heights) != 0) {
+		logWithCommand.Fatal("delta snapshot requires a single target block height")
+	}
+	header, err := selectHeader(edb)
 	if err != nil {
 		logWithCommand.Fatal(err)
 	}
-	height := viper.GetInt64(snapshot.SNAPSHOT_BLOCK_HEIGHT_TOML)
+	if header != nil {
+		if delta || len(heights) != 0 {
+			logWithCommand.Fatal("block hash, time and tag selectors cannot be combined with multiple heights or a delta snapshot")
+		}
+		height = header.Number.Int64()
+	}
+	stateRoot := viper.GetString(snapshot.SNAPSHOT_STATE_ROOT_TOML)
+	headerFile := viper.GetString(snapshot.SNAPSHOT_HEADER_FILE_TOML)
+	rootSnapshot := stateRoot != "" || headerFile != ""
+	var rootHeader *types.Header
+	if rootSnapshot {
+		if header != nil || delta || len(heights) != 0 {
+			logWithCommand.Fatal("state root and header file cannot be combined with other block selectors")
+		}
+		if headerFile != "" {
+			if rootHeader, err = snapshot.ReadHeaderJSON(headerFile); err != nil {
+				logWithCommand.Fatal(err)
+			}
+			height = rootHeader.Number.Int64()
+		} else if height < 0 {
+			height = 0
+		}
+	}
+	if viper.GetBool(snapshot.SNAPSHOT_CHECK_ONLY_TOML) {
+		if height >= 0 || len(heights) != 0 || header != nil || rootSnapshot {
+			logWithCommand.Fatal("check-only mode is only supported for snapshots at the latest block")
+		}
+		latest, err := snapshot.LatestHeaderWithState(edb)
+		if err != nil {
+			logWithCommand.Fatal(err)
+		}
+		logWithCommand.Infof("Latest block with available state is at height %d (hash %s, state root %s)",
+			latest.Number, latest.Hash(), latest.Root)
+		return
+	}
+	if viper.GetBool(snapshot.SNAPSHOT_DRY_RUN_TOML) {
+		if delta {
+			logWithCommand.Fatal("dry run is not supported for delta snapshots")
+		}
+		if len(config.Service.AllowedAccounts) != 0 {
+			logWithCommand.Warn("dry run estimates the size of the entire state, ignoring watched accounts")
+		}
+		params := snapshot.SnapshotParams{
+			Workers:   viper.GetUint(snapshot.SNAPSHOT_WORKERS_TOML),
+			Height:    uint64(height),
+			Heights:   heights,
+			StateRoot: common.HexToHash(stateRoot),
+			Header:    rootHeader,
+		}
+		if header == nil && !rootSnapshot && len(heights) == 0 && height < 0 {
+			if header, err = snapshot.LatestHeaderWithState(edb); err != nil {
+				logWithCommand.Fatal(err)
+			}
+		}
+		if header != nil {
+			params.BlockHash = header.Hash()
+		}
+		dryRun(edb, params)
+		return
+	}
+	if header == nil && !rootSnapshot && len(heights) == 0 && height < 0 {
+		// resolve the latest block up front, so that the default recovery file is named for it
+		if header, err = snapshot.LatestHeaderWithState(edb); err != nil {
+			logWithCommand.Fatal(err)
+		}
+		logWithCommand.Infof("Creating snapshot at latest block with available state, height %d", header.Number)
+		height = header.Number.Int64()
+	}
 	recoveryFile := viper.GetString(snapshot.SNAPSHOT_RECOVERY_FILE_TOML)
 	if recoveryFile == "" {
-		recoveryFile = fmt.Sprintf("./%d_snapshot_recovery", height)
+		recoveryFile = defaultRecoveryFile(height, heights)
 		logWithCommand.Infof("no recovery file set, using default: %s", recoveryFile)
 	}
 
-	var idxconfig indexer.Config
-	switch mode {
-	case snapshot.PgSnapshot:
-		idxconfig = *config.DB
-	case snapshot.FileSnapshot:
-		idxconfig = *config.File
-	}
-	_, indexer, err := indexer.NewStateDiffIndexer(
-		context.Background(),
-		nil, // ChainConfig is only used in PushBlock, which we don't call
-		config.Eth.NodeInfo,
-		idxconfig,
-		false,
-	)
-	if err != nil {
-		logWithCommand.Fatal(err)
+	indexer := newIndexer(config, edb, mode, delta)
+	db := openDB(config, mode)
+	if db != nil {
+		defer db.Close()
 	}
 
 	snapshotService, err := snapshot.NewSnapshotService(edb, indexer, recoveryFile)
 	if err != nil {
 		logWithCommand.Fatal(err)
 	}
+	policy, err := snapshot.ParseExistingPolicy(viper.GetString(snapshot.SNAPSHOT_EXISTING_TOML))
+	if err != nil {
+		logWithCommand.Fatal(err)
+	}
+	if viper.GetBool(snapshot.SNAPSHOT_VERIFY_TOML) || policy == snapshot.VerifyExisting {
+		if len(config.Service.AllowedAccounts) != 0 {
+			logWithCommand.Fatal("snapshots of watched addresses cannot be verified")
+		}
+		src, closeSrc := newIPLDSource(config, mode, db)
+		defer closeSrc()
+		snapshotService.SetVerifier(src)
+	}
+	snapshotService.SetCatalog(newCatalog(config, mode, db))
+	snapshotService.SetExistingPolicy(policy, newOutput(config, mode, db))
+	mismatch, err := snapshot.ParseRecoveryMismatchPolicy(viper.GetString(snapshot.SNAPSHOT_RECOVERY_MISMATCH_TOML))
+	if err != nil {
+		logWithCommand.Fatal(err)
+	}
+	snapshotService.SetRecoveryMismatchPolicy(mismatch)
+	snapshotService.SetRecoveryStore(newRecoveryStore(mode, db))
+	snapshotService.SetCommitInterval(viper.GetUint(snapshot.SNAPSHOT_COMMIT_INTERVAL_TOML))
+	snapshotService.SetCheckpointInterval(viper.GetDuration(snapshot.SNAPSHOT_CHECKPOINT_INTERVAL_TOML))
+	snapshotService.SetStorageSplit(viper.GetUint64(snapshot.SNAPSHOT_STORAGE_SPLIT_TOML))
+	snapshotService.SetDedupSize(viper.GetUint(snapshot.SNAPSHOT_DEDUP_SIZE_TOML))
+	setBatchSize(snapshotService)
+	snapshotService.SetOutputLocation(outputLocation(config, mode))
 	workers := viper.GetUint(snapshot.SNAPSHOT_WORKERS_TOML)
-	if height < 0 {
-		if err := snapshotService.CreateLatestSnapshot(workers, config.Service.AllowedAccounts); err != nil {
-			logWithCommand.Fatal(err)
+	ctx, cancel := signalContext()
+	defer cancel()
+	if delta {
+		params := snapshot.DeltaParams{
+			WatchedAddresses: config.Service.AllowedAccounts,
+			FromHeight:       uint64(fromHeight),
+			ToHeight:         uint64(height),
+			Workers:          workers,
 		}
-	} else {
-		params := snapshot.SnapshotParams{Workers: workers, Height: uint64(height), WatchedAddresses: config.Service.AllowedAccounts}
-		if err := snapshotService.CreateSnapshot(params); err != nil {
+		if err := snapshotService.CreateDeltaSnapshot(ctx, params); err != nil {
 			logWithCommand.Fatal(err)
 		}
+		logWithCommand.Infof("Delta snapshot from height %d to %d is complete", fromHeight, height)
+		return
+	}
+	params := snapshot.SnapshotParams{Workers: workers, WatchedAddresses: config.Service.AllowedAccounts}
+	switch {
+	case rootSnapshot:
+		params.Height = uint64(height)
+		params.StateRoot = common.HexToHash(stateRoot)
+		params.Header = rootHeader
+	case header != nil:
+		params.BlockHash = header.Hash()
+	case len(heights) != 0:
+		params.Heights = heights
+	default:
+		params.Height = uint64(height)
+	}
+	results, err := snapshotService.CreateSnapshot(ctx, params)
+	// report the snapshots completed before any failure
+	for _, result := range results {
+		logResult(result)
+	}
+	if resultFile := viper.GetString(snapshot.SNAPSHOT_RESULT_FILE_TOML); resultFile != "" {
+		if err := writeResults(resultFile, results); err != nil {
+			logWithCommand.Fatalf("unable to write results: %v", err)
+		}
+	}
+	if err != nil {
+		logWithCommand.Fatal(err)
+	}
+}
+
+// defaultRecoveryFile returns the recovery file to use for a snapshot at height, or at heights if
+// any are set, when none is configured.
+func defaultRecoveryFile(height int64, heights []uint64) string {
+	if len(heights) != 0 {
+		return fmt.Sprintf("./%d-%d_snapshot_recovery", heights[0], heights[len(heights)-1])
+	}
+	return fmt.Sprintf("./%d_snapshot_recovery", height)
+}
+
+// logResult logs what was written for a snapshot.
+func logResult(result *snapshot.SnapshotResult) {
+	entry := logWithCommand.WithField("height", result.Height).WithField("hash", result.BlockHash).
+		WithField("root", result.StateRoot)
+	switch result.Existing {
+	case snapshot.SkippedExisting, snapshot.VerifiedExisting:
+		entry.Infof("State snapshot already exists (%s)", result.Existing)
+		return
+	}
+	entry.WithField("headerID", result.HeaderID).WithField("workers", result.Workers).
+		WithField("output", result.Output).
+		Infof("State snapshot is complete: %d state nodes, %d storage nodes, %d IPLD blocks (%d bytes), %d code nodes in %s",
+			result.StateNodes, result.StorageNodes, result.IPLDs, result.Bytes, result.CodeNodes,
+			result.Duration.Round(time.Millisecond))
+}
+
+// writeResults writes the results of the snapshots to a file as a JSON array.
+func writeResults(path string, results []*snapshot.SnapshotResult) error {
+	if results == nil {
+		results = []*snapshot.SnapshotResult{}
 	}
-	logWithCommand.Infof("State snapshot at height %d is complete", height)
+	data, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// dryRun logs the estimated size of the snapshot, without writing anything.
+func dryRun(edb ethdb.Database, params snapshot.SnapshotParams) {
+	service, err := snapshot.NewSnapshotService(edb, nil, "")
+	if err != nil {
+		logWithCommand.Fatal(err)
+	}
+	estimates, err := service.EstimateSnapshot(params, snapshot.EstimateParams{})
+	if err != nil {
+		logWithCommand.Fatal(err)
+	}
+	for _, estimate := range estimates {
+		entry := logWithCommand.WithField("height", estimate.Height)
+		for i, sub := range estimate.Subtries {
+			entry.WithField("subtrie", i).WithField("start", sub.Start).WithField("end", sub.End).
+				Infof("estimated %d accounts, %d storage slots, %d IPLD blocks (%d bytes)",
+					sub.Accounts, sub.StorageSlots, sub.IPLDs, sub.IPLDBytes)
+		}
+		for table, size := range estimate.TableBytes {
+			entry.WithField("table", table).Infof("estimated output size %d bytes", size)
+		}
+		entry.WithField("flatSnapshot", estimate.FlatSnapshot).
+			Infof("estimated %d accounts, %d storage slots, %d state nodes, %d storage nodes, up to %d code nodes; "+
+				"traversal with %d workers should take about %s",
+				estimate.Total.Accounts, estimate.Total.StorageSlots, estimate.Total.StateNodes,
+				estimate.Total.StorageNodes, estimate.Total.CodeNodes, params.Workers, estimate.Duration.Round(time.Second))
+	}
+}
+
+// openDB connects to the output database in postgres mode, exiting on failure, or returns nil in
+// file mode. Its pool is shared by everything which reads or records state there, other than the
+// indexer, which opens its own from the same config.
+func openDB(config *snapshot.Config, mode snapshot.SnapshotMode) *sqlx.DB {
+	if mode != snapshot.PgSnapshot {
+		return nil
+	}
+	db, err := postgres.ConnectSQLX(context.Background(), *config.DB)
+	if err != nil {
+		logWithCommand.Fatalf("unable to connect to output database: %v", err)
+	}
+	return db
+}
+
+// newIPLDSource opens the output of the configured mode for verification, exiting on failure. The
+// returned function releases it.
+func newIPLDSource(config *snapshot.Config, mode snapshot.SnapshotMode, db *sqlx.DB) (snapshot.IPLDSource, func()) {
+	if mode == snapshot.PgSnapshot {
+		return snapshot.NewPgIPLDSource(db), func() {}
+	}
+	src, err := snapshot.NewFileIPLDSource(config.File.OutputDir)
+	if err != nil {
+		logWithCommand.Fatalf("unable to open output for verification: %v", err)
+	}
+	return src, func() { src.Close() }
+}
+
+// newCatalog opens the catalog of incomplete snapshots for the configured mode, exiting on failure.
+func newCatalog(config *snapshot.Config, mode snapshot.SnapshotMode, db *sqlx.DB) snapshot.Catalog {
+	switch mode {
+	case snapshot.PgSnapshot:
+		c, err := snapshot.NewPgCatalog(context.Background(), db)
+		if err != nil {
+			logWithCommand.Fatalf("unable to open snapshot catalog: %v", err)
+		}
+		return c
+	default:
+		return snapshot.NewFileCatalog(config.File.OutputDir)
+	}
+}
+
+// newRecoveryStore opens the configured store for recovery checkpoints, exiting on failure. The
+// postgres store uses the output database, so is only available in postgres mode.
+func newRecoveryStore(mode snapshot.SnapshotMode, db *sqlx.DB) snapshot.RecoveryStore {
+	switch store := snapshot.SnapshotMode(viper.GetString(snapshot.SNAPSHOT_RECOVERY_STORE_TOML)); store {
+	case snapshot.PgSnapshot:
+		if mode != snapshot.PgSnapshot {
+			logWithCommand.Fatal("postgres recovery store requires postgres output mode")
+		}
+		r, err := snapshot.NewPgRecoveryStore(context.Background(), db)
+		if err != nil {
+			logWithCommand.Fatalf("unable to open recovery store: %v", err)
+		}
+		return r
+	case snapshot.FileSnapshot:
+		return snapshot.NewFileRecoveryStore()
+	default:
+		logWithCommand.Fatalf("unknown recovery store %q", store)
+		return nil
+	}
+}
+
+// newOutput opens the output of the configured mode to check for existing snapshots.
+func newOutput(config *snapshot.Config, mode snapshot.SnapshotMode, db *sqlx.DB) snapshot.Output {
+	switch mode {
+	case snapshot.PgSnapshot:
+		return snapshot.NewPgOutput(db)
+	default:
+		return snapshot.NewFileOutput(config.File.OutputDir)
+	}
+}
+
+// outputLocation describes where the snapshot is written, without credentials.
+func outputLocation(config *snapshot.Config, mode snapshot.SnapshotMode) string {
+	switch mode {
+	case snapshot.PgSnapshot:
+		return fmt.Sprintf("postgres://%s:%d/%s", config.DB.Hostname, config.DB.Port, config.DB.DatabaseName)
+	default:
+		return config.File.OutputDir
+	}
+}
+
+// selectHeader resolves the block selected by hash, timestamp or tag. It returns nil if no such
+// selector is configured.
+func selectHeader(edb ethdb.Database) (*types.Header, error) {
+	hash := viper.GetString(snapshot.SNAPSHOT_BLOCK_HASH_TOML)
+	timestamp := viper.GetUint64(snapshot.SNAPSHOT_BLOCK_TIME_TOML)
+	tag := viper.GetString(snapshot.SNAPSHOT_BLOCK_TAG_TOML)
+
+	selectors := 0
+	for _, set := range []bool{hash != "", timestamp != 0, tag != ""} {
+		if set {
+			selectors++
+		}
+	}
+	if selectors > 1 {
+		return nil, fmt.Errorf("only one of block hash, time and tag may be set")
+	}
+	switch {
+	case hash != "":
+		return snapshot.HeaderByHash(edb, common.HexToHash(hash))
+	case timestamp != 0:
+		return snapshot.HeaderAtTime(edb, timestamp)
+	case tag != "":
+		return snapshot.HeaderByTag(edb, snapshot.BlockTag(tag))
+	}
+	return nil, nil
+}
+
+// blockHeight returns the configured block height, or -1 if it is unset, so that the latest block
+// with state available is used.
+func blockHeight() int64 {
+	value := viper.GetString(snapshot.SNAPSHOT_BLOCK_HEIGHT_TOML)
+	if value == "" {
+		return -1
+	}
+	height, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		logWithCommand.Fatalf("invalid block height %q: %v", value, err)
+	}
+	return height
+}
+
+// addSelectionFlags adds the flags selecting a snapshot's block and recovery checkpoints, which
+// the stateSnapshot and status commands share.
+func addSelectionFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().String(snapshot.SNAPSHOT_BLOCK_HEIGHT_CLI, "", "block height to extract state at")
+	cmd.PersistentFlags().String(snapshot.SNAPSHOT_BLOCK_HEIGHTS_CLI, "", "list or range of block heights to extract state at (e.g. '100,200' or '100:300:100'); overrides block-height")
+	cmd.PersistentFlags().String(snapshot.SNAPSHOT_BLOCK_HASH_CLI, "", "hash of the block to extract state at, which need not be canonical")
+	cmd.PersistentFlags().Uint64(snapshot.SNAPSHOT_BLOCK_TIME_CLI, 0, "extract state at the last block at or before this Unix timestamp")
+	cmd.PersistentFlags().String(snapshot.SNAPSHOT_BLOCK_TAG_CLI, "", "extract state at a tagged block ('latest', 'finalized' or 'safe')")
+	cmd.PersistentFlags().String(snapshot.SNAPSHOT_RECOVERY_FILE_CLI, "", "file to recover from a previous iteration")
+	cmd.PersistentFlags().String(snapshot.SNAPSHOT_RECOVERY_STORE_CLI, string(snapshot.FileSnapshot), "where to save recovery checkpoints ('file' or 'postgres')")
+}
+
+// bindSelectionFlags binds the selection flags of the command being run. Viper binds a single flag
+// to each key, so they are bound when a command runs rather than in init.
+func bindSelectionFlags(cmd *cobra.Command) {
+	viper.BindPFlag(snapshot.SNAPSHOT_BLOCK_HEIGHT_TOML, cmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_BLOCK_HEIGHT_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_BLOCK_HEIGHTS_TOML, cmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_BLOCK_HEIGHTS_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_BLOCK_HASH_TOML, cmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_BLOCK_HASH_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_BLOCK_TIME_TOML, cmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_BLOCK_TIME_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_BLOCK_TAG_TOML, cmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_BLOCK_TAG_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_RECOVERY_FILE_TOML, cmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_RECOVERY_FILE_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_RECOVERY_STORE_TOML, cmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_RECOVERY_STORE_CLI))
 }
 
 func init() {
 	rootCmd.AddCommand(stateSnapshotCmd)
 
-	stateSnapshotCmd.PersistentFlags().String(snapshot.ETHDB_PATH_CLI, "", "path to primary datastore")
-	stateSnapshotCmd.PersistentFlags().String(snapshot.ETHDB_ANCIENT_CLI, "", "path to ancient datastore")
-	stateSnapshotCmd.PersistentFlags().String(snapshot.SNAPSHOT_BLOCK_HEIGHT_CLI, "", "block height to extract state at")
-	stateSnapshotCmd.PersistentFlags().Int(snapshot.SNAPSHOT_WORKERS_CLI, 1, "number of concurrent workers to use")
-	stateSnapshotCmd.PersistentFlags().String(snapshot.SNAPSHOT_RECOVERY_FILE_CLI, "", "file to recover from a previous iteration")
-	stateSnapshotCmd.PersistentFlags().String(snapshot.SNAPSHOT_MODE_CLI, "postgres", "output mode for snapshot ('file' or 'postgres')")
-	stateSnapshotCmd.PersistentFlags().String(snapshot.FILE_OUTPUT_DIR_CLI, "", "directory for writing ouput to while operating in 'file' mode")
-	stateSnapshotCmd.PersistentFlags().StringArray(snapshot.SNAPSHOT_ACCOUNTS_CLI, nil, "list of account addresses to limit snapshot to")
-
-	viper.BindPFlag(snapshot.ETHDB_PATH_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.ETHDB_PATH_CLI))
-	viper.BindPFlag(snapshot.ETHDB_ANCIENT_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.ETHDB_ANCIENT_CLI))
-	viper.BindPFlag(snapshot.SNAPSHOT_BLOCK_HEIGHT_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_BLOCK_HEIGHT_CLI))
-	viper.BindPFlag(snapshot.SNAPSHOT_WORKERS_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_WORKERS_CLI))
-	viper.BindPFlag(snapshot.SNAPSHOT_RECOVERY_FILE_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_RECOVERY_FILE_CLI))
-	viper.BindPFlag(snapshot.SNAPSHOT_MODE_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_MODE_CLI))
-	viper.BindPFlag(snapshot.FILE_OUTPUT_DIR_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.FILE_OUTPUT_DIR_CLI))
-	viper.BindPFlag(snapshot.SNAPSHOT_ACCOUNTS_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_ACCOUNTS_CLI))
+	addSelectionFlags(stateSnapshotCmd)
+	stateSnapshotCmd.PersistentFlags().Int64(snapshot.SNAPSHOT_FROM_HEIGHT_CLI, -1, "if set, only write the state changed since this block height (delta snapshot)")
+	stateSnapshotCmd.PersistentFlags().String(snapshot.SNAPSHOT_STATE_ROOT_CLI, "", "state root to extract directly, written against a synthetic header at block-height unless header-file is set")
+	stateSnapshotCmd.PersistentFlags().String(snapshot.SNAPSHOT_HEADER_FILE_CLI, "", "JSON file holding the header to write for a state root snapshot")
+	stateSnapshotCmd.PersistentFlags().Bool(snapshot.SNAPSHOT_CHECK_ONLY_CLI, false, "only report the latest block whose state is available, without taking a snapshot")
+	stateSnapshotCmd.PersistentFlags().Bool(snapshot.SNAPSHOT_VERIFY_CLI, false, "verify that the state can be rebuilt from the output once the snapshot is written")
+	stateSnapshotCmd.PersistentFlags().Bool(snapshot.SNAPSHOT_DRY_RUN_CLI, false, "estimate the size and duration of the snapshot, without writing anything")
+	stateSnapshotCmd.PersistentFlags().String(snapshot.SNAPSHOT_EXISTING_CLI, string(snapshot.SkipExisting), "what to do with a snapshot already in the output for the same block ('skip', 'verify' or 'replace')")
+	stateSnapshotCmd.PersistentFlags().String(snapshot.SNAPSHOT_RECOVERY_MISMATCH_CLI, string(snapshot.FailOnMismatch), "what to do with a recovery file saved for a different snapshot ('fail', 'restart' or 'resume')")
+	stateSnapshotCmd.PersistentFlags().String(snapshot.SNAPSHOT_RESULT_FILE_CLI, "", "file to write the results of the snapshots to as JSON")
+	stateSnapshotCmd.PersistentFlags().Uint(snapshot.SNAPSHOT_COMMIT_INTERVAL_CLI, 0, "number of nodes to write per transaction, after which a recovery checkpoint is saved (0 commits once per subtrie)")
+	stateSnapshotCmd.PersistentFlags().Duration(snapshot.SNAPSHOT_CHECKPOINT_INTERVAL_CLI, time.Minute, "time after which the written nodes are committed and a recovery checkpoint is saved (0 to disable)")
+	stateSnapshotCmd.PersistentFlags().Uint64(snapshot.SNAPSHOT_STORAGE_SPLIT_CLI, 1000000, "estimated number of slots above which a storage trie is divided among the workers (0 to never divide)")
+	stateSnapshotCmd.PersistentFlags().Uint(snapshot.SNAPSHOT_DEDUP_SIZE_CLI, 1000000, "number of CIDs remembered to avoid writing IPLDs again at later heights (0 to disable)")
+
+	viper.BindPFlag(snapshot.SNAPSHOT_FROM_HEIGHT_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_FROM_HEIGHT_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_STATE_ROOT_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_STATE_ROOT_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_HEADER_FILE_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_HEADER_FILE_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_CHECK_ONLY_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_CHECK_ONLY_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_VERIFY_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_VERIFY_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_DRY_RUN_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_DRY_RUN_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_EXISTING_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_EXISTING_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_RECOVERY_MISMATCH_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_RECOVERY_MISMATCH_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_RESULT_FILE_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_RESULT_FILE_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_COMMIT_INTERVAL_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_COMMIT_INTERVAL_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_CHECKPOINT_INTERVAL_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_CHECKPOINT_INTERVAL_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_STORAGE_SPLIT_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_STORAGE_SPLIT_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_DEDUP_SIZE_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_DEDUP_SIZE_CLI))
 }
@@ -0,0 +1,85 @@
+// Copyright © 2024 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/cerc-io/ipld-eth-state-snapshot/pkg/snapshot"
+)
+
+// statediffRangeCmd represents the statediffRange command
+var statediffRangeCmd = &cobra.Command{
+	Use:   "statediffRange",
+	Short: "Extract per-block state diffs for a range of blocks from Ethdb and publish into PG-IPFS",
+	Long: `Usage
+
+./ipld-eth-state-snapshot statediffRange --config={path to toml config file} --start-height={N} --end-height={M}`,
+	Run: func(cmd *cobra.Command, args []string) {
+		subCommand = cmd.CalledAs()
+		logWithCommand = *logrus.WithField("SubCommand", subCommand)
+		statediffRange()
+	},
+}
+
+func statediffRange() {
+	mode := snapshot.SnapshotMode(viper.GetString(snapshot.SNAPSHOT_MODE_TOML))
+	config, err := snapshot.NewConfig(mode)
+	if err != nil {
+		logWithCommand.Fatalf("unable to initialize config: %v", err)
+	}
+	// a range defaulting to the genesis block alone is never what was meant
+	if !viper.IsSet(snapshot.STATEDIFF_START_HEIGHT_TOML) || !viper.IsSet(snapshot.STATEDIFF_END_HEIGHT_TOML) {
+		logWithCommand.Fatal("start and end heights must both be set")
+	}
+	start := viper.GetUint64(snapshot.STATEDIFF_START_HEIGHT_TOML)
+	end := viper.GetUint64(snapshot.STATEDIFF_END_HEIGHT_TOML)
+	if end < start {
+		logWithCommand.Fatalf("end height %d is below start height %d", end, start)
+	}
+	edb := openEthDB(config)
+	indexer := newIndexer(config, edb, mode, true)
+
+	service, err := snapshot.NewSnapshotService(edb, indexer, "")
+	if err != nil {
+		logWithCommand.Fatal(err)
+	}
+	setBatchSize(service)
+	ctx, cancel := signalContext()
+	defer cancel()
+	params := snapshot.StateDiffRangeParams{
+		WatchedAddresses: config.Service.AllowedAccounts,
+		Start:            start,
+		End:              end,
+		Workers:          viper.GetUint(snapshot.SNAPSHOT_WORKERS_TOML),
+	}
+	if err := service.CreateStateDiffs(ctx, params); err != nil {
+		logWithCommand.Fatal(err)
+	}
+	logWithCommand.Infof("State diffs for blocks %d to %d are complete", params.Start, params.End)
+}
+
+func init() {
+	rootCmd.AddCommand(statediffRangeCmd)
+
+	statediffRangeCmd.PersistentFlags().Uint64(snapshot.STATEDIFF_START_HEIGHT_CLI, 0, "first block height to write a state diff for (required)")
+	statediffRangeCmd.PersistentFlags().Uint64(snapshot.STATEDIFF_END_HEIGHT_CLI, 0, "last block height to write a state diff for (required)")
+
+	viper.BindPFlag(snapshot.STATEDIFF_START_HEIGHT_TOML, statediffRangeCmd.PersistentFlags().Lookup(snapshot.STATEDIFF_START_HEIGHT_CLI))
+	viper.BindPFlag(snapshot.STATEDIFF_END_HEIGHT_TOML, statediffRangeCmd.PersistentFlags().Lookup(snapshot.STATEDIFF_END_HEIGHT_CLI))
+}
@@ -0,0 +1,208 @@
+// Copyright © 2024 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/jmoiron/sqlx"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/cerc-io/ipld-eth-state-snapshot/pkg/snapshot"
+)
+
+// statusCmd reports how far an interrupted snapshot got
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Report the progress saved in the recovery file of an interrupted snapshot",
+	Long: `Usage
+
+./ipld-eth-state-snapshot status --config={path to toml config file}
+
+Reads the recovery file of the snapshot selected by the same configuration as stateSnapshot, and
+prints each unfinished range with its position and estimated completion, and whether the file
+matches the configuration. If an ethdb is configured, the snapshot's block is read from it, so that
+the state root and block hash are checked too.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		subCommand = cmd.CalledAs()
+		logWithCommand = *logrus.WithField("SubCommand", subCommand)
+		bindSelectionFlags(cmd)
+		status()
+	},
+}
+
+func status() {
+	mode := snapshot.SnapshotMode(viper.GetString(snapshot.SNAPSHOT_MODE_TOML))
+	config, err := snapshot.NewConfig(mode)
+	if err != nil {
+		logWithCommand.Fatalf("unable to initialize config: %v", err)
+	}
+	height := blockHeight()
+	heights := config.Service.BlockHeights
+	params := snapshot.SnapshotParams{
+		Workers:          viper.GetUint(snapshot.SNAPSHOT_WORKERS_TOML),
+		WatchedAddresses: config.Service.AllowedAccounts,
+	}
+
+	// the ethdb is optional, and only needed to check the state root and block hash
+	var edb ethdb.Database
+	var headers []*types.Header
+	if config.Eth.DBPath != "" {
+		edb = openEthDB(config)
+		defer edb.Close()
+		header, err := selectHeader(edb)
+		if err != nil {
+			logWithCommand.Fatal(err)
+		}
+		switch {
+		case header != nil:
+			params.BlockHash = header.Hash()
+		case len(heights) != 0:
+			params.Heights = heights
+		case height >= 0:
+			params.Height = uint64(height)
+		default:
+			if header, err = snapshot.LatestHeaderWithState(edb); err != nil {
+				logWithCommand.Fatal(err)
+			}
+			params.BlockHash = header.Hash()
+		}
+		if header != nil {
+			height = header.Number.Int64()
+		}
+	}
+	service, err := snapshot.NewSnapshotService(edb, nil, "")
+	if err != nil {
+		logWithCommand.Fatal(err)
+	}
+	if edb != nil {
+		if headers, err = service.ResolveHeaders(params); err != nil {
+			logWithCommand.Fatal(err)
+		}
+	}
+	// the output database is only needed if checkpoints are saved there
+	var db *sqlx.DB
+	if snapshot.SnapshotMode(viper.GetString(snapshot.SNAPSHOT_RECOVERY_STORE_TOML)) == snapshot.PgSnapshot {
+		if db = openDB(config, mode); db != nil {
+			defer db.Close()
+		}
+	}
+	service.SetRecoveryStore(newRecoveryStore(mode, db))
+	service.SetOutputLocation(outputLocation(config, mode))
+
+	recoveryFile := viper.GetString(snapshot.SNAPSHOT_RECOVERY_FILE_TOML)
+	if recoveryFile == "" {
+		if height < 0 && len(heights) == 0 {
+			logWithCommand.Fatal("a recovery file or block height must be set when no ethdb is configured")
+		}
+		recoveryFile = defaultRecoveryFile(height, heights)
+	}
+	// as when snapshotting, each of multiple heights has its own recovery file
+	names, selected := []string{recoveryFile}, []*types.Header{nil}
+	if len(heights) > 1 {
+		names, selected = nil, nil
+		for _, h := range heights {
+			names = append(names, fmt.Sprintf("%s_%d", recoveryFile, h))
+			selected = append(selected, nil)
+		}
+	}
+	copy(selected, headers)
+
+	out := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	defer out.Flush()
+	for i, name := range names {
+		status, err := service.RecoveryStatus(context.Background(), name, selected[i], params)
+		if err != nil {
+			logWithCommand.Fatal(err)
+		}
+		printStatus(out, name, status, params.Workers)
+	}
+}
+
+// printStatus prints a recovery checkpoint's identity and ranges, and whether it matches the
+// configuration.
+func printStatus(out *tabwriter.Writer, name string, status *snapshot.RecoveryStatus, workers uint) {
+	if status == nil {
+		fmt.Fprintf(out, "%s: no recovery checkpoint\n\n", name)
+		return
+	}
+	fmt.Fprintf(out, "%s: recovery file version %d\n", name, status.Version)
+	if status.Version >= 2 {
+		fmt.Fprintf(out, "State root:\t%s\n", status.StateRoot)
+		fmt.Fprintf(out, "Block hash:\t%s\n", status.BlockHash)
+		fmt.Fprintf(out, "Watched addresses:\t%s\n", formatAddresses(status.WatchedAddresses))
+		fmt.Fprintf(out, "Workers:\t%d\n", status.Workers)
+		fmt.Fprintf(out, "Output:\t%s\n", status.Output)
+	}
+	if len(status.Mismatches) == 0 {
+		fmt.Fprintf(out, "Matches config:\tyes\n")
+	} else {
+		fmt.Fprintf(out, "Matches config:\tno (%s)\n", strings.Join(status.Mismatches, "; "))
+	}
+	if status.Workers != 0 && status.Workers != max(workers, 1) {
+		fmt.Fprintf(out, "\t(the ranges are repartitioned to resume with %d workers)\n", max(workers, 1))
+	}
+	fmt.Fprintf(out, "State trie done:\t%.1f%%\n\n", status.Percent)
+
+	fmt.Fprintln(out, "RANGE\tTRIE\tSTART\tPOSITION\tEND\tDONE")
+	for i, r := range status.Ranges {
+		trie := "state"
+		if r.Account != (common.Hash{}) {
+			trie = "storage " + r.Account.Hex()
+		}
+		start, done := "?", "?"
+		if r.Percent >= 0 {
+			start, done = formatPath(r.Start, "start"), fmt.Sprintf("%.1f%%", r.Percent)
+		}
+		fmt.Fprintf(out, "%d\t%s\t%s\t%s\t%s\t%s\n",
+			i, trie, start, formatPath(r.Position, "start"), formatPath(r.End, "end"), done)
+	}
+	fmt.Fprintln(out)
+}
+
+// formatPath formats a path in nibbles, naming an empty one.
+func formatPath(path []byte, empty string) string {
+	if len(path) == 0 {
+		return empty
+	}
+	return fmt.Sprintf("%x", path)
+}
+
+func formatAddresses(addrs []common.Address) string {
+	if len(addrs) == 0 {
+		return "all"
+	}
+	var strs []string
+	for _, addr := range addrs {
+		strs = append(strs, addr.Hex())
+	}
+	return strings.Join(strs, ", ")
+}
+
+func init() {
+	rootCmd.AddCommand(statusCmd)
+
+	addSelectionFlags(statusCmd)
+}
@@ -0,0 +1,121 @@
+package mocks
+
+import (
+	"context"
+	dbsql "database/sql"
+	"strings"
+	"sync"
+
+	"github.com/cerc-io/plugeth-statediff/indexer/database/metrics"
+	"github.com/cerc-io/plugeth-statediff/indexer/database/sql"
+)
+
+// Driver is a sql.Driver which records the statements run in each committed transaction
+type Driver struct {
+	sync.Mutex
+
+	Committed [][]Statement
+	Rollbacks int
+}
+
+// Statement is a statement run with its arguments, or a COPY of rows into a table
+type Statement struct {
+	SQL  string
+	Args []interface{}
+}
+
+// DriverTx holds the statements run in it until it is committed
+type DriverTx struct {
+	driver     *Driver
+	statements []Statement
+}
+
+type noRow struct{}
+
+var _ sql.Driver = (*Driver)(nil)
+
+// NewDriver returns a mock driver with nothing committed
+func NewDriver() *Driver {
+	return &Driver{}
+}
+
+// Rows returns the arguments of each committed statement with the given SQL, in order
+func (d *Driver) Rows(stm string) [][]interface{} {
+	d.Lock()
+	defer d.Unlock()
+	var rows [][]interface{}
+	for _, tx := range d.Committed {
+		for _, s := range tx {
+			if s.SQL == stm {
+				rows = append(rows, s.Args)
+			}
+		}
+	}
+	return rows
+}
+
+func (d *Driver) UseCopyFrom() bool { return false }
+
+func (d *Driver) QueryRow(context.Context, string, ...interface{}) sql.ScannableRow {
+	return noRow{}
+}
+
+// Exec commits a single statement
+func (d *Driver) Exec(_ context.Context, stm string, args ...interface{}) (sql.Result, error) {
+	d.Lock()
+	defer d.Unlock()
+	d.Committed = append(d.Committed, []Statement{{SQL: stm, Args: args}})
+	return nil, nil
+}
+
+func (d *Driver) Select(context.Context, interface{}, string, ...interface{}) error {
+	return dbsql.ErrNoRows
+}
+
+func (d *Driver) Get(context.Context, interface{}, string, ...interface{}) error {
+	return dbsql.ErrNoRows
+}
+
+func (d *Driver) Begin(context.Context) (sql.Tx, error) {
+	return &DriverTx{driver: d}, nil
+}
+
+func (d *Driver) Stats() metrics.DbStats   { return nil }
+func (d *Driver) NodeID() string           { return "" }
+func (d *Driver) Context() context.Context { return context.Background() }
+func (d *Driver) Close() error             { return nil }
+
+func (tx *DriverTx) QueryRow(context.Context, string, ...interface{}) sql.ScannableRow {
+	return noRow{}
+}
+
+func (tx *DriverTx) Exec(_ context.Context, stm string, args ...interface{}) (sql.Result, error) {
+	tx.statements = append(tx.statements, Statement{SQL: stm, Args: args})
+	return nil, nil
+}
+
+func (tx *DriverTx) CopyFrom(_ context.Context, table []string, _ []string, rows [][]interface{}) (int64, error) {
+	stm := "COPY " + strings.Join(table, ".")
+	for _, row := range rows {
+		tx.statements = append(tx.statements, Statement{SQL: stm, Args: row})
+	}
+	return int64(len(rows)), nil
+}
+
+func (tx *DriverTx) Commit(context.Context) error {
+	tx.driver.Lock()
+	defer tx.driver.Unlock()
+	tx.driver.Committed = append(tx.driver.Committed, tx.statements)
+	tx.statements = nil
+	return nil
+}
+
+func (tx *DriverTx) Rollback(context.Context) error {
+	tx.driver.Lock()
+	defer tx.driver.Unlock()
+	tx.driver.Rollbacks++
+	tx.statements = nil
+	return nil
+}
+
+func (noRow) Scan(...interface{}) error { return dbsql.ErrNoRows }
@@ -25,6 +25,8 @@ type IndexerData struct {
 	Headers    map[uint64]*types.Header
 	StateNodes []sdtypes.StateLeafNode
 	IPLDs      []sdtypes.IPLD
+	Blocks     map[uint64]*types.Block
+	Receipts   map[uint64]types.Receipts
 }
 
 // no-op mock Batch
@@ -36,11 +38,22 @@ func NewIndexer(t *testing.T) *Indexer {
 	return &Indexer{
 		MockgenIndexer: NewMockgenIndexer(ctl),
 		IndexerData: IndexerData{
-			Headers: make(map[uint64]*types.Header),
+			Headers:  make(map[uint64]*types.Header),
+			Blocks:   make(map[uint64]*types.Block),
+			Receipts: make(map[uint64]types.Receipts),
 		},
 	}
 }
 
+func (i *Indexer) PushBlock(block *types.Block, receipts types.Receipts, _ *big.Int) (indexer.Batch, error) {
+	i.Lock()
+	defer i.Unlock()
+	i.Headers[block.NumberU64()] = block.Header()
+	i.Blocks[block.NumberU64()] = block
+	i.Receipts[block.NumberU64()] = receipts
+	return Batch{}, nil
+}
+
 func (i *Indexer) PushHeader(_ indexer.Batch, header *types.Header, _, _ *big.Int) (string, error) {
 	i.Lock()
 	defer i.Unlock()
@@ -55,6 +68,20 @@ func (i *Indexer) PushStateNode(_ indexer.Batch, stateNode sdtypes.StateLeafNode
 	return nil
 }
 
+// PushStorageNodes adds storage nodes to the last state node pushed for their account, which must
+// have been pushed first.
+func (i *Indexer) PushStorageNodes(_ indexer.Batch, stateKey []byte, nodes []sdtypes.StorageLeafNode, _ string) error {
+	i.Lock()
+	defer i.Unlock()
+	for j := len(i.StateNodes) - 1; j >= 0; j-- {
+		if string(i.StateNodes[j].AccountWrapper.LeafKey) == string(stateKey) {
+			i.StateNodes[j].StorageDiff = append(i.StateNodes[j].StorageDiff, nodes...)
+			return nil
+		}
+	}
+	return fmt.Errorf("storage nodes pushed before state node %x", stateKey)
+}
+
 func (i *Indexer) PushIPLD(_ indexer.Batch, ipld sdtypes.IPLD) error {
 	i.Lock()
 	defer i.Unlock()
@@ -70,19 +97,169 @@ func (Batch) Submit() error           { return nil }
 func (Batch) BlockNumber() string     { return "0" }
 func (Batch) RollbackOnFailure(error) {}
 
+// TxIndexer only records the data pushed to a batch once the batch is submitted. Like the database,
+// it ignores state nodes, storage nodes and IPLDs which have already been recorded. The storage nodes
+// of a state node which is pushed again are added to those recorded with it.
+type TxIndexer struct {
+	*Indexer
+
+	Commits   int
+	Rollbacks int
+	// stateKeys maps the recorded state nodes' leaf keys to their index in StateNodes
+	stateKeys   map[string]int
+	storageKeys map[string]struct{}
+	ipldKeys    map[string]struct{}
+}
+
+// TxBatch holds the data pushed to it until it is submitted
+type TxBatch struct {
+	indexer    *TxIndexer
+	headers    []*types.Header
+	stateNodes []sdtypes.StateLeafNode
+	storage    []storageNodes
+	iplds      []sdtypes.IPLD
+	onSubmit   []func()
+}
+
+// storageNodes are storage nodes pushed apart from their account's state node
+type storageNodes struct {
+	stateKey []byte
+	nodes    []sdtypes.StorageLeafNode
+}
+
+// NewTxIndexer returns a mock indexer that caches data in lists on each commit
+func NewTxIndexer(t *testing.T) *TxIndexer {
+	return &TxIndexer{
+		Indexer:     NewIndexer(t),
+		stateKeys:   make(map[string]int),
+		storageKeys: make(map[string]struct{}),
+		ipldKeys:    make(map[string]struct{}),
+	}
+}
+
+func (i *TxIndexer) BeginTx(_ *big.Int, _ context.Context) indexer.Batch {
+	return &TxBatch{indexer: i}
+}
+
+func (i *TxIndexer) PushHeader(b indexer.Batch, header *types.Header, _, _ *big.Int) (string, error) {
+	batch := b.(*TxBatch)
+	batch.headers = append(batch.headers, header)
+	return header.Hash().String(), nil
+}
+
+func (i *TxIndexer) PushStateNode(b indexer.Batch, stateNode sdtypes.StateLeafNode, _ string) error {
+	batch := b.(*TxBatch)
+	batch.stateNodes = append(batch.stateNodes, stateNode)
+	return nil
+}
+
+func (i *TxIndexer) PushStorageNodes(b indexer.Batch, stateKey []byte, nodes []sdtypes.StorageLeafNode, _ string) error {
+	batch := b.(*TxBatch)
+	batch.storage = append(batch.storage, storageNodes{stateKey: stateKey, nodes: nodes})
+	return nil
+}
+
+func (i *TxIndexer) PushIPLD(b indexer.Batch, ipld sdtypes.IPLD) error {
+	batch := b.(*TxBatch)
+	batch.iplds = append(batch.iplds, ipld)
+	return nil
+}
+
+func (b *TxBatch) Submit() error {
+	i := b.indexer
+	i.Lock()
+	defer i.Unlock()
+	for _, header := range b.headers {
+		i.Headers[header.Number.Uint64()] = header
+	}
+	for _, node := range b.stateNodes {
+		index := i.stateIndex(node.AccountWrapper.LeafKey)
+		// the account's storage may have been recorded first
+		i.StateNodes[index].AccountWrapper = node.AccountWrapper
+		i.addStorage(index, node.StorageDiff)
+	}
+	for _, storage := range b.storage {
+		i.addStorage(i.stateIndex(storage.stateKey), storage.nodes)
+	}
+	for _, ipld := range b.iplds {
+		if _, has := i.ipldKeys[ipld.CID]; !has {
+			i.ipldKeys[ipld.CID] = struct{}{}
+			i.IPLDs = append(i.IPLDs, ipld)
+		}
+	}
+	for _, f := range b.onSubmit {
+		f()
+	}
+	i.Commits++
+	return nil
+}
+
+// OnSubmit adds a function to call when the batch is submitted, along with recording its data
+func (b *TxBatch) OnSubmit(f func()) {
+	b.onSubmit = append(b.onSubmit, f)
+}
+
+// stateIndex returns the index in StateNodes of the state node with the given leaf key, adding one
+// if it has not been recorded.
+func (i *TxIndexer) stateIndex(stateKey []byte) int {
+	index, has := i.stateKeys[string(stateKey)]
+	if !has {
+		index = len(i.StateNodes)
+		i.stateKeys[string(stateKey)] = index
+		i.StateNodes = append(i.StateNodes, sdtypes.StateLeafNode{AccountWrapper: sdtypes.AccountWrapper{LeafKey: stateKey}})
+	}
+	return index
+}
+
+func (i *TxIndexer) addStorage(index int, nodes []sdtypes.StorageLeafNode) {
+	stateKey := string(i.StateNodes[index].AccountWrapper.LeafKey)
+	for _, storage := range nodes {
+		storageKey := stateKey + string(storage.LeafKey)
+		if _, has := i.storageKeys[storageKey]; !has {
+			i.storageKeys[storageKey] = struct{}{}
+			i.StateNodes[index].StorageDiff = append(i.StateNodes[index].StorageDiff, storage)
+		}
+	}
+}
+
+func (b *TxBatch) BlockNumber() string { return "0" }
+
+func (b *TxBatch) RollbackOnFailure(err error) {
+	if err != nil {
+		b.indexer.Lock()
+		b.indexer.Rollbacks++
+		b.indexer.Unlock()
+	}
+}
+
 // InterruptingIndexer triggers an artificial failure at a specific node count
 type InterruptingIndexer struct {
-	*Indexer
+	*TxIndexer
 
 	InterruptAfter uint
+	pushed         uint
 }
 
 func (i *InterruptingIndexer) PushStateNode(b indexer.Batch, stateNode sdtypes.StateLeafNode, h string) error {
-	i.RLock()
-	indexedCount := len(i.StateNodes)
-	i.RUnlock()
-	if indexedCount >= int(i.InterruptAfter) {
+	i.Lock()
+	indexedCount := i.pushed
+	i.pushed++
+	i.Unlock()
+	if indexedCount >= i.InterruptAfter {
+		return fmt.Errorf("mock interrupt")
+	}
+	return i.TxIndexer.PushStateNode(b, stateNode, h)
+}
+
+// PushStorageNodes counts storage nodes pushed apart from their account toward the interrupt, as
+// one node.
+func (i *InterruptingIndexer) PushStorageNodes(b indexer.Batch, stateKey []byte, nodes []sdtypes.StorageLeafNode, h string) error {
+	i.Lock()
+	indexedCount := i.pushed
+	i.pushed++
+	i.Unlock()
+	if indexedCount >= i.InterruptAfter {
 		return fmt.Errorf("mock interrupt")
 	}
-	return i.Indexer.PushStateNode(b, stateNode, h)
+	return i.TxIndexer.PushStorageNodes(b, stateKey, nodes, h)
 }
@@ -17,6 +17,8 @@
 package prom
 
 import (
+	"strconv"
+
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
@@ -33,6 +35,9 @@ var (
 
 	stateNodeCount   prometheus.Counter
 	storageNodeCount prometheus.Counter
+	codeNodeCount    prometheus.Counter
+
+	writeQueueDepth *prometheus.GaugeVec
 )
 
 func Init() {
@@ -51,6 +56,20 @@ func Init() {
 		Name:      "storage_node_count",
 		Help:      "Number of storage nodes processed",
 	})
+
+	codeNodeCount = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: statsSubsystem,
+		Name:      "code_node_count",
+		Help:      "Number of code nodes processed",
+	})
+
+	writeQueueDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: statsSubsystem,
+		Name:      "write_queue_depth",
+		Help:      "Number of records waiting in each writer's queue",
+	}, []string{"writer"})
 }
 
 func RegisterGaugeFunc(name string, function func() float64) {
@@ -84,6 +103,20 @@ func AddStorageNodeCount(count int) {
 	}
 }
 
+// IncCodeNodeCount increments the number of code nodes processed
+func IncCodeNodeCount() {
+	if metrics {
+		codeNodeCount.Inc()
+	}
+}
+
+// AddWriteQueueDepth adds delta to the number of records queued for a writer
+func AddWriteQueueDepth(writer int, delta int) {
+	if metrics {
+		writeQueueDepth.WithLabelValues(strconv.Itoa(writer)).Add(float64(delta))
+	}
+}
+
 func Enabled() bool {
 	return metrics
 }
@@ -6,16 +6,16 @@ import (
 	"sync"
 	"sync/atomic"
 
-	iterutil "github.com/cerc-io/eth-iterator-utils"
-	"github.com/cerc-io/eth-iterator-utils/tracker"
 	"github.com/ethereum/go-ethereum/trie"
 )
 
 var trackedIterCount atomic.Int32
 
-// Tracker which wraps a tracked iterators in metrics-reporting iterators
-type MetricsTracker struct {
-	*tracker.TrackerImpl
+// RangeIterator is an iterator whose progress through its range is reported as a gauge.
+type RangeIterator interface {
+	trie.NodeIterator
+	// SetEnd moves the end of the range, when the rest of it is split off.
+	SetEnd(endPath []byte)
 }
 
 type metricsIterator struct {
@@ -24,21 +24,17 @@ type metricsIterator struct {
 	// count    uint
 	done     bool
 	lastPath []byte
+	endPath  []byte
 	sync.RWMutex
 }
 
-func NewTracker(file string, bufsize uint) *MetricsTracker {
-	return &MetricsTracker{TrackerImpl: tracker.NewImpl(file, bufsize)}
-}
-
-func (t *MetricsTracker) wrap(tracked *tracker.Iterator) *metricsIterator {
-	startPath, endPath := tracked.Bounds()
-	pathDepth := max(max(len(startPath), len(endPath)), 1)
-	totalSteps := estimateSteps(startPath, endPath, pathDepth)
-
+// TrackIterator wraps an iterator bounded by startPath and endPath in one which reports its
+// progress through that range as a gauge.
+func TrackIterator(it trie.NodeIterator, startPath, endPath []byte) RangeIterator {
 	ret := &metricsIterator{
-		NodeIterator: tracked,
+		NodeIterator: it,
 		id:           trackedIterCount.Add(1),
+		endPath:      endPath,
 	}
 
 	RegisterGaugeFunc(
@@ -47,40 +43,37 @@ func (t *MetricsTracker) wrap(tracked *tracker.Iterator) *metricsIterator {
 			ret.RLock()
 			done := ret.done
 			lastPath := ret.lastPath
+			endPath := ret.endPath
 			ret.RUnlock()
 
 			if done {
 				return 100.0
 			}
-
-			if lastPath == nil {
-				return 0.0
-			}
-
-			// estimate remaining distance based on current position and node count
-			remainingSteps := estimateSteps(lastPath, endPath, pathDepth)
-			return (float64(totalSteps) - float64(remainingSteps)) / float64(totalSteps) * 100.0
+			return RangeProgress(startPath, endPath, lastPath)
 		})
 	return ret
 }
 
-func (t *MetricsTracker) Restore(ctor iterutil.IteratorConstructor) (
-	[]trie.NodeIterator, []trie.NodeIterator, error,
-) {
-	iters, bases, err := t.TrackerImpl.Restore(ctor)
-	if err != nil {
-		return nil, nil, err
-	}
-	ret := make([]trie.NodeIterator, len(iters))
-	for i, tracked := range iters {
-		ret[i] = t.wrap(tracked)
-	}
-	return ret, bases, nil
+func (it *metricsIterator) SetEnd(endPath []byte) {
+	it.Lock()
+	defer it.Unlock()
+	it.endPath = endPath
 }
 
-func (t *MetricsTracker) Tracked(it trie.NodeIterator) trie.NodeIterator {
-	tracked := t.TrackerImpl.Tracked(it)
-	return t.wrap(tracked)
+// RangeProgress estimates the percentage of the range from startPath to endPath which an iterator
+// has covered once it reaches path. A nil path is taken to be the start of the range.
+func RangeProgress(startPath, endPath, path []byte) float64 {
+	if path == nil {
+		return 0.0
+	}
+	pathDepth := max(max(len(startPath), len(endPath)), 1)
+	totalSteps := estimateSteps(startPath, endPath, pathDepth)
+	if totalSteps == 0 {
+		return 100.0
+	}
+	// estimate remaining distance based on current position and node count
+	remainingSteps := estimateSteps(path, endPath, pathDepth)
+	return (float64(totalSteps) - float64(remainingSteps)) / float64(totalSteps) * 100.0
 }
 
 func (it *metricsIterator) Next(descend bool) bool {
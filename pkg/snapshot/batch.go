@@ -0,0 +1,511 @@
+// Copyright © 2024 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cerc-io/plugeth-statediff/indexer"
+	sdtypes "github.com/cerc-io/plugeth-statediff/types"
+
+	"github.com/cerc-io/ipld-eth-state-snapshot/pkg/prom"
+)
+
+// SetBatchSize sets the number of records, and if bytes is non-zero their approximate size in
+// bytes, at which the records queued for a writer are written to the indexer as a batch. A state
+// node and each of its storage nodes count as one record each, as does each IPLD block.
+func (s *Service) SetBatchSize(records, bytes uint) {
+	s.maxBatchSize = records
+	s.maxBatchBytes = bytes
+}
+
+// SetWriters sets the number of goroutines writing records to the indexer, and the number of
+// records which may be queued for each before the workers emitting them wait. If writers is 0,
+// there is one writer per worker.
+func (s *Service) SetWriters(writers, queueLength uint) {
+	s.writers = writers
+	s.queueLength = queueLength
+}
+
+// writerCount returns the number of writers used for a snapshot with the given number of workers.
+func (s *Service) writerCount(workers uint) int {
+	n := s.writers
+	if n == 0 {
+		n = workers
+	}
+	if n == 0 {
+		n = 1
+	}
+	return int(n)
+}
+
+// StorageIndexer is implemented by indexers which can write the storage nodes of an account apart
+// from its state node. Storage tries are only divided among workers if the indexer implements it,
+// so that each account's state node is written once.
+type StorageIndexer interface {
+	// PushStorageNodes writes storage nodes of the account with the given state leaf key.
+	PushStorageNodes(tx indexer.Batch, stateKey []byte, nodes []sdtypes.StorageLeafNode, headerID string) error
+}
+
+// batchRecord is a state node, storage nodes of an account or IPLD block waiting to be written.
+type batchRecord struct {
+	node    *sdtypes.StateLeafNode
+	storage *storageRecord
+	ipld    *sdtypes.IPLD
+	code    bool
+}
+
+// storageRecord holds storage nodes of the account with the given leaf key, which are written
+// apart from its state node.
+type storageRecord struct {
+	leafKey []byte
+	nodes   []sdtypes.StorageLeafNode
+}
+
+type batch struct {
+	records []batchRecord
+	// count and size are the number of records, including storage nodes, and their approximate
+	// size in bytes
+	count, size uint
+	// ipldCount is the number of IPLD blocks
+	ipldCount uint
+}
+
+// queueItem is either a record or a checkpoint marker.
+type queueItem struct {
+	record batchRecord
+	count  uint
+	size   uint
+	marker *checkpointMarker
+}
+
+// checkpointMarker is queued to every writer after the records it covers.
+type checkpointMarker struct {
+	cp checkpoint
+	// seq numbers the markers of a snapshot in the order they are queued, from 1
+	seq uint64
+	// remaining is the number of writers which have yet to commit up to the marker
+	remaining int
+}
+
+// pipeline passes the records emitted by the builder's workers to a set of writers, so that trie
+// reads are not held up by writes. Each record goes to the queue of one writer, chosen by its key,
+// so IPLD blocks can be deduplicated by each writer without sharing state. A worker waits when
+// the queue it sends to is full.
+//
+// To save a checkpoint of the tracker, a marker holding it is queued to every writer. Records
+// emitted before the iterators' saved positions were queued before the marker, so once every
+// writer has committed up to the marker, the checkpoint can be saved. Markers are queued to the
+// writers in the same order, so checkpoints are saved in order.
+//
+// If the recovery store is a TxRecoveryStore, each writer instead saves the checkpoint in its own
+// transaction, committing it with the records before the marker. The store keeps the checkpoint of
+// each writer, and the earliest of them covers what all writers have committed.
+type pipeline struct {
+	service  *Service
+	tracker  *iteratorTracker
+	headerID string
+	counts   *nodeCounts
+	writers  []*writer
+	// onFail is called on the first failure to save a checkpoint
+	onFail func()
+	// txStore is set if checkpoints are committed by the writers
+	txStore bool
+
+	// sinceCheckpoint counts the IPLDs queued since the last checkpoint
+	sinceCheckpoint atomic.Uint64
+	// stopTicker stops the periodic checkpoints
+	stopTicker func()
+	// markMtx orders the markers queued to the writers, and guards seq
+	markMtx sync.Mutex
+	seq     uint64
+	// ackMtx guards the markers' remaining counts
+	ackMtx sync.Mutex
+	wg     sync.WaitGroup
+
+	errMtx sync.Mutex
+	err    error
+}
+
+// writer writes the records in its queue through its own transaction.
+type writer struct {
+	p     *pipeline
+	index int
+	tx    *chunkedTx
+	queue chan queueItem
+	seen  *boundedCIDSet
+	// pending holds the CIDs written since the last commit, which are added to seen once committed
+	pending cidSet
+	codes   cidSet
+	batch   batch
+}
+
+// newPipeline starts a writer for each of txs, adding what is written to counts. If seen is
+// non-nil, it holds a set for each writer, IPLDs already present in it are skipped, and those the
+// writer commits are added to it. Contract
+// code is emitted once per account by the builder, so it is always deduplicated. If tracker is
+// non-nil, a checkpoint is saved once a tracked iterator is done, after every commit interval and
+// at every checkpoint interval. onFail is called on the first failure to save a checkpoint.
+func (s *Service) newPipeline(
+	txs []*chunkedTx, tracker *iteratorTracker, headerID string, seen []*boundedCIDSet, counts *nodeCounts,
+	onFail func(),
+) *pipeline {
+	queueLength := s.queueLength
+	if queueLength == 0 {
+		queueLength = defaultQueueLength
+	}
+	p := &pipeline{
+		service:  s,
+		tracker:  tracker,
+		headerID: headerID,
+		counts:   counts,
+		onFail:   onFail,
+	}
+	for i, tx := range txs {
+		w := &writer{
+			p:     p,
+			index: i,
+			tx:    tx,
+			queue: make(chan queueItem, queueLength),
+			codes: make(cidSet),
+		}
+		if seen != nil {
+			w.seen = seen[i]
+			w.pending = make(cidSet)
+		}
+		p.writers = append(p.writers, w)
+		p.wg.Add(1)
+		go w.run()
+	}
+	p.stopTicker = func() {}
+	if tracker != nil {
+		tracker.onDone = p.checkpoint
+		tracker.writers = len(txs)
+		_, p.txStore = tracker.store.(TxRecoveryStore)
+		if s.checkpointInterval > 0 {
+			p.stopTicker = p.tick(s.checkpointInterval)
+		}
+	}
+	return p
+}
+
+// tick queues a checkpoint at each interval if any IPLDs have been queued since the last one, until
+// the returned function is called.
+func (p *pipeline) tick(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.markMtx.Lock()
+				if p.sinceCheckpoint.Load() > 0 {
+					p.checkpointLocked()
+				}
+				p.markMtx.Unlock()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-exited
+	}
+}
+
+// sinks returns state node and IPLD sinks which queue records to the writers.
+func (p *pipeline) sinks() (sdtypes.StateNodeSink, sdtypes.IPLDSink) {
+	nodeSink := func(node sdtypes.StateLeafNode) error {
+		storage := uint(len(node.StorageDiff))
+		w := p.writers[shardIndex(node.AccountWrapper.LeafKey, len(p.writers))]
+		w.enqueue(queueItem{
+			record: batchRecord{node: &node},
+			count:  1 + storage,
+			size:   stateRowSize + storage*storageRowSize,
+		})
+		return nil
+	}
+	ipldSink := func(c sdtypes.IPLD) error {
+		code, err := isCode(c)
+		if err != nil {
+			return err
+		}
+		// the same CID always goes to the same writer, which deduplicates it
+		w := p.writers[shardIndex(c.CID, len(p.writers))]
+		w.enqueue(queueItem{
+			record: batchRecord{ipld: &c, code: code},
+			count:  1,
+			size:   ipldRowSize + uint(len(c.Content)),
+		})
+		// every trie node and code blob is emitted as an IPLD, so these are what count as nodes
+		p.counted()
+		return nil
+	}
+	return nodeSink, ipldSink
+}
+
+// storageSink returns a sink which queues storage nodes apart from their account's state node, or
+// nil if the indexer cannot write them. They go to the same writer as the account.
+func (p *pipeline) storageSink() storageSink {
+	if _, ok := p.service.indexer.(StorageIndexer); !ok {
+		return nil
+	}
+	return func(leafKey []byte, nodes []sdtypes.StorageLeafNode) error {
+		w := p.writers[shardIndex(leafKey, len(p.writers))]
+		w.enqueue(queueItem{
+			record: batchRecord{storage: &storageRecord{leafKey: leafKey, nodes: nodes}},
+			count:  uint(len(nodes)),
+			size:   uint(len(nodes)) * storageRowSize,
+		})
+		return nil
+	}
+}
+
+// shardIndex maps a key to one of n shards, using the FNV-1a hash.
+func shardIndex[K string | []byte](key K, n int) int {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return int(h % uint32(n))
+}
+
+// checkpoint queues a marker with a checkpoint of the tracker to every writer.
+func (p *pipeline) checkpoint() {
+	p.markMtx.Lock()
+	defer p.markMtx.Unlock()
+	p.checkpointLocked()
+}
+
+func (p *pipeline) checkpointLocked() {
+	p.sinceCheckpoint.Store(0)
+	p.seq++
+	m := &checkpointMarker{seq: p.seq, remaining: len(p.writers)}
+	if p.tracker != nil {
+		m.cp = p.tracker.Checkpoint()
+	}
+	for _, w := range p.writers {
+		w.enqueue(queueItem{marker: m})
+	}
+}
+
+// counted counts an IPLD since the last checkpoint, and queues a checkpoint once the commit
+// interval is reached.
+func (p *pipeline) counted() {
+	if p.tracker == nil {
+		return
+	}
+	interval := uint64(p.service.commitInterval)
+	if p.sinceCheckpoint.Add(1) < interval || interval == 0 {
+		return
+	}
+	p.markMtx.Lock()
+	defer p.markMtx.Unlock()
+	// another worker may have queued a checkpoint in the meantime
+	if p.sinceCheckpoint.Load() >= interval {
+		p.checkpointLocked()
+	}
+}
+
+// ack records that a writer has committed up to a marker, and saves its checkpoint once all have,
+// unless the writers committed it. If the output must be synced for its commits to be durable, that
+// is done first.
+func (p *pipeline) ack(m *checkpointMarker) {
+	p.ackMtx.Lock()
+	defer p.ackMtx.Unlock()
+	m.remaining--
+	if m.remaining > 0 || p.tracker == nil || p.txStore && len(m.cp) != 0 {
+		return
+	}
+	if output, ok := p.service.output.(SyncedOutput); ok {
+		if err := output.Sync(); err != nil {
+			p.fail(fmt.Errorf("failed to sync output for recovery checkpoint: %w", err))
+			return
+		}
+	}
+	if err := p.tracker.Save(m.cp); err != nil {
+		p.fail(fmt.Errorf("failed to save recovery checkpoint: %w", err))
+	}
+}
+
+func (p *pipeline) fail(err error) {
+	p.errMtx.Lock()
+	defer p.errMtx.Unlock()
+	if p.err == nil {
+		p.err = err
+		if p.onFail != nil {
+			p.onFail()
+		}
+	}
+}
+
+// Err returns the failures to write, commit or save a checkpoint, if any.
+func (p *pipeline) Err() error {
+	p.errMtx.Lock()
+	errs := []error{p.err}
+	p.errMtx.Unlock()
+	for _, w := range p.writers {
+		errs = append(errs, w.tx.Err())
+	}
+	return errors.Join(errs...)
+}
+
+// Close stops the writers once the records queued so far are written. If commit is set, the
+// remaining records are written and committed with a final checkpoint, otherwise they are
+// discarded. It returns any failure to write, commit or save a checkpoint.
+func (p *pipeline) Close(commit bool) error {
+	p.stopTicker()
+	if commit {
+		p.checkpoint()
+	}
+	for _, w := range p.writers {
+		close(w.queue)
+	}
+	p.wg.Wait()
+	return p.Err()
+}
+
+func (w *writer) enqueue(item queueItem) {
+	prom.AddWriteQueueDepth(w.index, 1)
+	w.queue <- item
+}
+
+// run writes records in batches until the queue is closed, committing at each marker. After a
+// failure, records are discarded.
+func (w *writer) run() {
+	defer w.p.wg.Done()
+	for item := range w.queue {
+		prom.AddWriteQueueDepth(w.index, -1)
+		if item.marker != nil {
+			if w.flush() == nil && w.saveCheckpoint(item.marker) == nil && w.tx.Commit() == nil {
+				w.committed()
+				w.p.ack(item.marker)
+			}
+			continue
+		}
+		b := &w.batch
+		b.records = append(b.records, item.record)
+		b.count += item.count
+		b.size += item.size
+		if item.record.ipld != nil {
+			b.ipldCount++
+		}
+		maxRecords, maxBytes := w.p.service.maxBatchSize, w.p.service.maxBatchBytes
+		if b.count >= maxRecords || (maxBytes != 0 && b.size >= maxBytes) {
+			w.flush()
+		}
+	}
+}
+
+// saveCheckpoint writes a marker's checkpoint in the writer's transaction, if checkpoints are
+// committed by the writers. The final checkpoint, once all iterators are done, is empty, and the
+// saved one is removed instead once all writers have committed.
+func (w *writer) saveCheckpoint(m *checkpointMarker) error {
+	p := w.p
+	if p.tracker == nil || !p.txStore || len(m.cp) == 0 {
+		return nil
+	}
+	return w.tx.push(0, func(tx indexer.Batch) error {
+		return p.tracker.SaveTx(tx, w.index, m.seq, m.cp)
+	})
+}
+
+// committed adds the CIDs written since the last commit to the seen set. Those of a transaction
+// which is not committed are never added, so they are written again at later heights.
+func (w *writer) committed() {
+	if w.seen == nil {
+		return
+	}
+	for c := range w.pending {
+		w.seen.add(c)
+	}
+	clear(w.pending)
+}
+
+// flush writes the current batch.
+func (w *writer) flush() error {
+	b := w.batch
+	w.batch = batch{}
+	if len(b.records) == 0 {
+		return w.tx.Err()
+	}
+	return w.tx.push(b.ipldCount, func(tx indexer.Batch) error {
+		for _, r := range b.records {
+			var err error
+			if r.node != nil {
+				err = w.writeNode(tx, r.node)
+			} else if r.storage != nil {
+				err = w.writeStorage(tx, r.storage)
+			} else {
+				err = w.writeIPLD(tx, r.ipld, r.code)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (w *writer) writeNode(tx indexer.Batch, node *sdtypes.StateLeafNode) error {
+	prom.IncStateNodeCount()
+	prom.AddStorageNodeCount(len(node.StorageDiff))
+	if err := w.p.service.indexer.PushStateNode(tx, *node, w.p.headerID); err != nil {
+		return err
+	}
+	w.p.counts.state.Add(1)
+	w.p.counts.storage.Add(uint64(len(node.StorageDiff)))
+	return nil
+}
+
+func (w *writer) writeStorage(tx indexer.Batch, r *storageRecord) error {
+	prom.AddStorageNodeCount(len(r.nodes))
+	if err := w.p.service.indexer.(StorageIndexer).PushStorageNodes(tx, r.leafKey, r.nodes, w.p.headerID); err != nil {
+		return err
+	}
+	w.p.counts.storage.Add(uint64(len(r.nodes)))
+	return nil
+}
+
+func (w *writer) writeIPLD(tx indexer.Batch, c *sdtypes.IPLD, code bool) error {
+	if code && !w.codes.add(c.CID) {
+		return nil
+	}
+	if w.seen != nil && (w.seen.has(c.CID) || !w.pending.add(c.CID)) {
+		return nil
+	}
+	if code {
+		prom.IncCodeNodeCount()
+	}
+	if err := w.p.service.indexer.PushIPLD(tx, *c); err != nil {
+		return err
+	}
+	if code {
+		w.p.counts.codes.Add(1)
+	}
+	w.p.counts.iplds.Add(1)
+	w.p.counts.bytes.Add(uint64(len(c.Content)))
+	return nil
+}
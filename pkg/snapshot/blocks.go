@@ -0,0 +1,93 @@
+// Copyright © 2024 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/params"
+	log "github.com/sirupsen/logrus"
+)
+
+// ReadChainConfig reads the chain config stored in the ethdb alongside the genesis block.
+func ReadChainConfig(db ethdb.Reader) (*params.ChainConfig, error) {
+	genesis := rawdb.ReadCanonicalHash(db, 0)
+	config := rawdb.ReadChainConfig(db, genesis)
+	if config == nil {
+		return nil, fmt.Errorf("no chain config found for genesis block %s", genesis)
+	}
+	return config, nil
+}
+
+// BlockRangeParams specifies a range of blocks to index. Both ends of the range are inclusive.
+type BlockRangeParams struct {
+	Start uint64
+	End   uint64
+}
+
+// IndexBlocks publishes the header, uncles, transactions, receipts, logs and withdrawals of each
+// canonical block in the range. The indexer must have been created with the chain's config. If ctx
+// is cancelled, the blocks already indexed are kept.
+func (s *Service) IndexBlocks(ctx context.Context, params BlockRangeParams) error {
+	if params.End < params.Start {
+		return fmt.Errorf("invalid block range %d to %d", params.Start, params.End)
+	}
+	log.WithField("start", params.Start).WithField("end", params.End).Info("Indexing blocks")
+
+	for height := params.Start; ; height++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := s.indexBlock(height); err != nil {
+			return fmt.Errorf("failed to index block at height %d: %w", height, err)
+		}
+		log.WithField("height", height).Debug("Block indexed")
+		if height == params.End {
+			return nil
+		}
+	}
+}
+
+func (s *Service) indexBlock(height uint64) error {
+	hash := rawdb.ReadCanonicalHash(s.ethDB, height)
+	block := rawdb.ReadBlock(s.ethDB, hash, height)
+	if block == nil {
+		return fmt.Errorf("unable to read canonical block %s", hash)
+	}
+	// the indexer derives the receipt fields which are not stored
+	receipts := rawdb.ReadRawReceipts(s.ethDB, hash, height)
+	if receipts == nil {
+		return fmt.Errorf("unable to read receipts for block %s", hash)
+	}
+	td := rawdb.ReadTd(s.ethDB, hash, height)
+	if td == nil {
+		log.WithField("height", height).Warn("Total difficulty not found, using zero")
+		td = big.NewInt(0)
+	}
+
+	tx, err := s.indexer.PushBlock(block, receipts, td)
+	if err != nil {
+		return err
+	}
+	if err = tx.Submit(); err != nil {
+		return fmt.Errorf("batch transaction submission failed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package snapshot_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cerc-io/plugeth-statediff/indexer"
+	"github.com/cerc-io/plugeth-statediff/indexer/database/file"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cerc-io/ipld-eth-state-snapshot/internal/mocks"
+	. "github.com/cerc-io/ipld-eth-state-snapshot/pkg/snapshot"
+	fixture "github.com/cerc-io/ipld-eth-state-snapshot/test"
+)
+
+func TestIndexBlocks(t *testing.T) {
+	var start, end uint64 = 1, 16
+	edb := openEthDB(t, fixture.ChainA)
+
+	idx := mocks.NewIndexer(t)
+	service, err := NewSnapshotService(edb, idx, "")
+	require.NoError(t, err)
+	require.NoError(t, service.IndexBlocks(context.Background(), BlockRangeParams{Start: start, End: end}))
+
+	require.Len(t, idx.Blocks, int(end-start+1))
+	var txCount int
+	for height := start; height <= end; height++ {
+		require.Contains(t, idx.Blocks, height)
+		block := idx.Blocks[height]
+		require.Equal(t, rawdb.ReadCanonicalHash(edb, height), block.Hash())
+		require.Len(t, idx.Receipts[height], len(block.Transactions()))
+		txCount += len(block.Transactions())
+	}
+	require.NotZero(t, txCount)
+}
+
+func TestIndexBlocksToFile(t *testing.T) {
+	edb := openEthDB(t, fixture.ChainA)
+	chainConfig, err := ReadChainConfig(edb)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	outputDir := filepath.Join(dir, "output")
+	config := file.Config{
+		Mode:                     file.CSV,
+		OutputDir:                outputDir,
+		WatchedAddressesFilePath: filepath.Join(dir, "watched-addresses.csv"),
+	}
+	_, idx, err := indexer.NewStateDiffIndexer(context.Background(), chainConfig, DefaultNodeInfo, config, false)
+	require.NoError(t, err)
+	service, err := NewSnapshotService(edb, idx, "")
+	require.NoError(t, err)
+	require.NoError(t, service.IndexBlocks(context.Background(), BlockRangeParams{Start: 1, End: 16}))
+	require.NoError(t, idx.Close())
+
+	for _, table := range []string{"eth.header_cids", "eth.transaction_cids", "eth.receipt_cids"} {
+		info, err := os.Stat(filepath.Join(outputDir, table+".csv"))
+		require.NoError(t, err)
+		require.NotZero(t, info.Size(), table)
+	}
+}
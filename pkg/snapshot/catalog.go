@@ -0,0 +1,125 @@
+// Copyright © 2024 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/jmoiron/sqlx"
+)
+
+// Catalog records alongside the output which snapshots are incomplete, since a failed snapshot
+// may leave some of its output committed.
+type Catalog interface {
+	// MarkIncomplete records that the snapshot at header failed with the given cause.
+	MarkIncomplete(ctx context.Context, header *types.Header, cause error) error
+	// MarkComplete clears any record that the snapshot at header is incomplete.
+	MarkComplete(ctx context.Context, header *types.Header) error
+	// IsIncomplete reports whether the snapshot at header is recorded as incomplete.
+	IsIncomplete(ctx context.Context, header *types.Header) (bool, error)
+}
+
+// SetCatalog sets the catalog in which the outcome of each snapshot is recorded.
+func (s *Service) SetCatalog(catalog Catalog) {
+	s.catalog = catalog
+}
+
+// FileCatalog marks incomplete snapshots with a file in the output directory, named by the height
+// and hash of the header and holding the error.
+type FileCatalog struct {
+	dir string
+}
+
+func NewFileCatalog(outputDir string) *FileCatalog {
+	return &FileCatalog{dir: outputDir}
+}
+
+func (c *FileCatalog) path(header *types.Header) string {
+	return filepath.Join(c.dir, fmt.Sprintf("%d_%s.incomplete", header.Number, header.Hash().Hex()))
+}
+
+func (c *FileCatalog) MarkIncomplete(_ context.Context, header *types.Header, cause error) error {
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(c.path(header), []byte(cause.Error()+"\n"), 0644)
+}
+
+func (c *FileCatalog) MarkComplete(_ context.Context, header *types.Header) error {
+	err := os.Remove(c.path(header))
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	return err
+}
+
+func (c *FileCatalog) IsIncomplete(_ context.Context, header *types.Header) (bool, error) {
+	_, err := os.Stat(c.path(header))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// PgCatalog marks incomplete snapshots in the eth_meta.incomplete_snapshots table, which is
+// created if it does not exist.
+type PgCatalog struct {
+	db *sqlx.DB
+}
+
+const (
+	pgCreateCatalogStm = `CREATE TABLE IF NOT EXISTS eth_meta.incomplete_snapshots (
+		block_number BIGINT NOT NULL,
+		block_hash VARCHAR(66) NOT NULL,
+		error TEXT NOT NULL,
+		updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+		PRIMARY KEY (block_number, block_hash)
+	)`
+	pgMarkIncompleteStm = `INSERT INTO eth_meta.incomplete_snapshots (block_number, block_hash, error)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (block_number, block_hash) DO UPDATE SET error = EXCLUDED.error, updated_at = now()`
+	pgMarkCompleteStm = `DELETE FROM eth_meta.incomplete_snapshots WHERE block_number = $1 AND block_hash = $2`
+	pgIsIncompleteStm = `SELECT EXISTS (
+		SELECT 1 FROM eth_meta.incomplete_snapshots WHERE block_number = $1 AND block_hash = $2)`
+)
+
+// NewPgCatalog uses the database the snapshot is written to, which is not closed with it.
+func NewPgCatalog(ctx context.Context, db *sqlx.DB) (*PgCatalog, error) {
+	if _, err := db.ExecContext(ctx, pgCreateCatalogStm); err != nil {
+		return nil, fmt.Errorf("failed to create snapshot catalog table: %w", err)
+	}
+	return &PgCatalog{db: db}, nil
+}
+
+func (c *PgCatalog) MarkIncomplete(ctx context.Context, header *types.Header, cause error) error {
+	_, err := c.db.ExecContext(ctx, pgMarkIncompleteStm, header.Number.Uint64(), header.Hash().Hex(), cause.Error())
+	return err
+}
+
+func (c *PgCatalog) MarkComplete(ctx context.Context, header *types.Header) error {
+	_, err := c.db.ExecContext(ctx, pgMarkCompleteStm, header.Number.Uint64(), header.Hash().Hex())
+	return err
+}
+
+func (c *PgCatalog) IsIncomplete(ctx context.Context, header *types.Header) (bool, error) {
+	var incomplete bool
+	err := c.db.GetContext(ctx, &incomplete, pgIsIncompleteStm, header.Number.Uint64(), header.Hash().Hex())
+	return incomplete, err
+}
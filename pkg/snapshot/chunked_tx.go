@@ -0,0 +1,136 @@
+// Copyright © 2024 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"sync"
+
+	"github.com/cerc-io/plugeth-statediff/indexer"
+	log "github.com/sirupsen/logrus"
+)
+
+// chunkedTx writes a snapshot through a series of indexer transactions rather than a single one.
+// Each writer of a snapshot has its own chunkedTx, which is committed whenever the writer reaches a
+// checkpoint. Without checkpoints, everything is written in one transaction.
+type chunkedTx struct {
+	ctx     context.Context
+	indexer indexer.Indexer
+	height  *big.Int
+	// onFail is called on the first failure to write or commit
+	onFail func()
+
+	sync.Mutex
+	tx    indexer.Batch
+	nodes uint
+	// err is the first failure, after which nothing more can be written
+	err error
+}
+
+func newChunkedTx(ctx context.Context, indexer indexer.Indexer, height *big.Int) *chunkedTx {
+	return &chunkedTx{
+		ctx:     ctx,
+		indexer: indexer,
+		height:  height,
+	}
+}
+
+// newChunkedTxs creates a chunkedTx for each of n writers, which call onFail on their first failure.
+func newChunkedTxs(
+	ctx context.Context, indexer indexer.Indexer, height *big.Int, n int, onFail func(),
+) []*chunkedTx {
+	txs := make([]*chunkedTx, n)
+	for i := range txs {
+		txs[i] = newChunkedTx(ctx, indexer, height)
+		txs[i].onFail = onFail
+	}
+	return txs
+}
+
+// push runs write against the current transaction, which counts as the given number of nodes
+// toward the commit interval.
+func (c *chunkedTx) push(nodes uint, write func(indexer.Batch) error) error {
+	c.Lock()
+	defer c.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	if c.tx == nil {
+		c.tx = c.indexer.BeginTx(c.height, c.ctx)
+	}
+	if err := write(c.tx); err != nil {
+		return c.fail(err)
+	}
+	c.nodes += nodes
+	return nil
+}
+
+// Commit commits the current transaction.
+func (c *chunkedTx) Commit() error {
+	c.Lock()
+	defer c.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	if c.tx != nil {
+		err := c.tx.Submit()
+		// a submitted transaction is closed, even if it failed
+		c.tx = nil
+		if err != nil {
+			return c.fail(fmt.Errorf("batch transaction submission failed: %w", err))
+		}
+		log.WithField("height", c.height).WithField("nodes", c.nodes).Debug("Committed snapshot chunk")
+		c.nodes = 0
+	}
+	return nil
+}
+
+func (c *chunkedTx) fail(err error) error {
+	if c.err == nil {
+		c.err = err
+		if c.onFail != nil {
+			c.onFail()
+		}
+	}
+	return err
+}
+
+// Err returns the first failure to write or commit, if any.
+func (c *chunkedTx) Err() error {
+	c.Lock()
+	defer c.Unlock()
+	return c.err
+}
+
+// RollbackOnFailure rolls back the current transaction if err is non-nil. Chunks which have already
+// been committed are kept.
+func (c *chunkedTx) RollbackOnFailure(err error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.tx != nil && err != nil {
+		c.tx.RollbackOnFailure(err)
+		c.tx = nil
+	}
+}
+
+// rollbackOnFailure rolls back the current transaction of each of txs if err is non-nil.
+func rollbackOnFailure(txs []*chunkedTx, err error) {
+	for _, tx := range txs {
+		tx.RollbackOnFailure(err)
+	}
+}
@@ -17,6 +17,8 @@ package snapshot
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
@@ -63,6 +65,8 @@ type FileConfig = file.Config
 
 type ServiceConfig struct {
 	AllowedAccounts []common.Address
+	// BlockHeights is set when multiple heights are to be snapshotted in one run.
+	BlockHeights []uint64
 }
 
 func NewConfig(mode SnapshotMode) (*Config, error) {
@@ -162,9 +166,35 @@ func InitFile(c *FileConfig) error {
 
 func (c *ServiceConfig) Init() error {
 	viper.BindEnv(SNAPSHOT_BLOCK_HEIGHT_TOML, SNAPSHOT_BLOCK_HEIGHT)
+	viper.BindEnv(SNAPSHOT_BLOCK_HEIGHTS_TOML, SNAPSHOT_BLOCK_HEIGHTS)
+	viper.BindEnv(SNAPSHOT_FROM_HEIGHT_TOML, SNAPSHOT_FROM_HEIGHT)
+	viper.BindEnv(SNAPSHOT_BLOCK_HASH_TOML, SNAPSHOT_BLOCK_HASH)
+	viper.BindEnv(SNAPSHOT_BLOCK_TIME_TOML, SNAPSHOT_BLOCK_TIME)
+	viper.BindEnv(SNAPSHOT_BLOCK_TAG_TOML, SNAPSHOT_BLOCK_TAG)
+	viper.BindEnv(SNAPSHOT_STATE_ROOT_TOML, SNAPSHOT_STATE_ROOT)
+	viper.BindEnv(SNAPSHOT_HEADER_FILE_TOML, SNAPSHOT_HEADER_FILE)
+	viper.BindEnv(SNAPSHOT_CHECK_ONLY_TOML, SNAPSHOT_CHECK_ONLY)
+	viper.BindEnv(SNAPSHOT_VERIFY_TOML, SNAPSHOT_VERIFY)
+	viper.BindEnv(SNAPSHOT_DRY_RUN_TOML, SNAPSHOT_DRY_RUN)
+	viper.BindEnv(SNAPSHOT_EXISTING_TOML, SNAPSHOT_EXISTING)
+	viper.BindEnv(SNAPSHOT_COMMIT_INTERVAL_TOML, SNAPSHOT_COMMIT_INTERVAL)
+	viper.BindEnv(SNAPSHOT_CHECKPOINT_INTERVAL_TOML, SNAPSHOT_CHECKPOINT_INTERVAL)
+	viper.BindEnv(SNAPSHOT_STORAGE_SPLIT_TOML, SNAPSHOT_STORAGE_SPLIT)
+	viper.BindEnv(SNAPSHOT_DEDUP_SIZE_TOML, SNAPSHOT_DEDUP_SIZE)
+	viper.BindEnv(SNAPSHOT_RESULT_FILE_TOML, SNAPSHOT_RESULT_FILE)
 	viper.BindEnv(SNAPSHOT_MODE_TOML, SNAPSHOT_MODE)
 	viper.BindEnv(SNAPSHOT_WORKERS_TOML, SNAPSHOT_WORKERS)
+	viper.BindEnv(SNAPSHOT_BATCH_SIZE_TOML, SNAPSHOT_BATCH_SIZE)
+	viper.BindEnv(SNAPSHOT_BATCH_BYTES_TOML, SNAPSHOT_BATCH_BYTES)
+	viper.BindEnv(SNAPSHOT_WRITERS_TOML, SNAPSHOT_WRITERS)
+	viper.BindEnv(SNAPSHOT_QUEUE_LENGTH_TOML, SNAPSHOT_QUEUE_LENGTH)
 	viper.BindEnv(SNAPSHOT_RECOVERY_FILE_TOML, SNAPSHOT_RECOVERY_FILE)
+	viper.BindEnv(SNAPSHOT_RECOVERY_MISMATCH_TOML, SNAPSHOT_RECOVERY_MISMATCH)
+	viper.BindEnv(SNAPSHOT_RECOVERY_STORE_TOML, SNAPSHOT_RECOVERY_STORE)
+	viper.BindEnv(STATEDIFF_START_HEIGHT_TOML, STATEDIFF_START_HEIGHT)
+	viper.BindEnv(STATEDIFF_END_HEIGHT_TOML, STATEDIFF_END_HEIGHT)
+	viper.BindEnv(BLOCKS_START_HEIGHT_TOML, BLOCKS_START_HEIGHT)
+	viper.BindEnv(BLOCKS_END_HEIGHT_TOML, BLOCKS_END_HEIGHT)
 
 	viper.BindEnv(PROM_DB_STATS_TOML, PROM_DB_STATS)
 	viper.BindEnv(PROM_HTTP_TOML, PROM_HTTP)
@@ -184,5 +214,52 @@ func (c *ServiceConfig) Init() error {
 	} else {
 		logrus.Infof("no snapshot addresses specified, will perform snapshot of entire trie(s)")
 	}
+
+	heights, err := ParseBlockHeights(viper.GetString(SNAPSHOT_BLOCK_HEIGHTS_TOML))
+	if err != nil {
+		return err
+	}
+	c.BlockHeights = heights
 	return nil
 }
+
+// ParseBlockHeights parses a comma-separated list of block heights, where each element is either a
+// single height or an inclusive range with a step, in the form "first:last:step" (e.g.
+// "1000000:3000000:1000000"). The step may be omitted, in which case it defaults to 1.
+func ParseBlockHeights(s string) ([]uint64, error) {
+	var heights []uint64
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	for _, elem := range strings.Split(s, ",") {
+		parts := strings.Split(strings.TrimSpace(elem), ":")
+		if len(parts) > 3 {
+			return nil, fmt.Errorf("invalid block height range %q", elem)
+		}
+		values := make([]uint64, len(parts))
+		for i, part := range parts {
+			var err error
+			if values[i], err = strconv.ParseUint(part, 10, 64); err != nil {
+				return nil, fmt.Errorf("invalid block height %q: %w", part, err)
+			}
+		}
+		if len(values) == 1 {
+			heights = append(heights, values[0])
+			continue
+		}
+		first, last, step := values[0], values[1], uint64(1)
+		if len(values) == 3 {
+			step = values[2]
+		}
+		if step == 0 || last < first {
+			return nil, fmt.Errorf("invalid block height range %q", elem)
+		}
+		for height := first; ; height += step {
+			heights = append(heights, height)
+			if last-height < step {
+				break
+			}
+		}
+	}
+	return heights, nil
+}
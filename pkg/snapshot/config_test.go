@@ -1,8 +1,13 @@
 package snapshot_test
 
 import (
+	"testing"
+
 	"github.com/cerc-io/plugeth-statediff/indexer/database/sql/postgres"
 	ethnode "github.com/cerc-io/plugeth-statediff/indexer/node"
+	"github.com/stretchr/testify/require"
+
+	. "github.com/cerc-io/ipld-eth-state-snapshot/pkg/snapshot"
 )
 
 var (
@@ -25,3 +30,27 @@ var (
 		MaxConns:        4,
 	}
 )
+
+func TestParseBlockHeights(t *testing.T) {
+	cases := []struct {
+		input    string
+		expected []uint64
+	}{
+		{"", nil},
+		{"32", []uint64{32}},
+		{"1,5, 9", []uint64{1, 5, 9}},
+		{"100:300:100", []uint64{100, 200, 300}},
+		{"100:350:100", []uint64{100, 200, 300}},
+		{"1:3,10", []uint64{1, 2, 3, 10}},
+	}
+	for _, tc := range cases {
+		heights, err := ParseBlockHeights(tc.input)
+		require.NoError(t, err, tc.input)
+		require.Equal(t, tc.expected, heights, tc.input)
+	}
+
+	for _, input := range []string{"x", "1:2:3:4", "5:1", "1:5:0", "-1"} {
+		_, err := ParseBlockHeights(input)
+		require.Error(t, err, input)
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright © 2024 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	statediff "github.com/cerc-io/plugeth-statediff"
+	"github.com/cerc-io/plugeth-statediff/adapt"
+	sdtypes "github.com/cerc-io/plugeth-statediff/types"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// DeltaParams specifies a delta snapshot, which contains only the state which changed between two
+// blocks. Applied on top of a full snapshot at FromHeight, it yields the state at ToHeight.
+type DeltaParams struct {
+	WatchedAddresses []common.Address
+	FromHeight       uint64
+	ToHeight         uint64
+	Workers          uint
+}
+
+// CreateDeltaSnapshot publishes the header at ToHeight along with the state and storage nodes which
+// differ between the canonical blocks at FromHeight and ToHeight. Nodes which were removed are
+// published as "removed" records. The diff is written in a single transaction. If ctx is cancelled,
+// the builder stops at its next node, the transaction is rolled back and the context's error is
+// returned.
+func (s *Service) CreateDeltaSnapshot(ctx context.Context, params DeltaParams) error {
+	if params.ToHeight <= params.FromHeight {
+		return fmt.Errorf("delta target height %d is not above source height %d",
+			params.ToHeight, params.FromHeight)
+	}
+	from, err := s.canonicalHeader(params.FromHeight)
+	if err != nil {
+		return err
+	}
+	to, err := s.canonicalHeader(params.ToHeight)
+	if err != nil {
+		return err
+	}
+	log.WithField("from", params.FromHeight).WithField("to", params.ToHeight).
+		WithField("hash", to.Hash()).Info("Creating delta snapshot")
+
+	return s.writeStateDiff(ctx, from.Root, to, params.WatchedAddresses, params.Workers)
+}
+
+// writeStateDiff publishes the header and the difference between the state at oldRoot and the state
+// at the header.
+func (s *Service) writeStateDiff(
+	ctx context.Context, oldRoot common.Hash, header *types.Header, watchedAddresses []common.Address, workers uint,
+) (err error) {
+	txs := newChunkedTxs(ctx, s.indexer, header.Number, s.writerCount(workers), nil)
+	defer func() { rollbackOnFailure(txs, err) }()
+
+	headerid, err := s.pushHeader(txs[0], header)
+	if err != nil {
+		return err
+	}
+	writers := s.newPipeline(txs, nil, headerid, nil, new(nodeCounts), nil)
+	nodeSink, ipldSink := writers.sinks()
+
+	sdargs := statediff.Args{
+		OldStateRoot: oldRoot,
+		NewStateRoot: header.Root,
+		BlockHash:    header.Hash(),
+		BlockNumber:  header.Number,
+	}
+	sdparams := statediff.Params{
+		WatchedAddresses: watchedAddresses,
+	}
+	sdparams.ComputeWatchedAddressesLeafPaths()
+	builder := statediff.NewBuilder(adapt.GethStateView(s.stateDB))
+	builder.SetSubtrieWorkers(workers)
+	// the builder takes no context, so its sinks fail once ctx is done, which stops its workers
+	nodeSink, ipldSink = interruptibleSinks(ctx, nodeSink, ipldSink)
+	err = builder.WriteStateDiff(sdargs, sdparams, nodeSink, ipldSink)
+	// ctx may be done after the last node was emitted, but the diff is then no longer wanted
+	if err == nil {
+		err = ctx.Err()
+	}
+	if txErr := writers.Close(err == nil); txErr != nil && !errors.Is(err, txErr) {
+		err = errors.Join(err, txErr)
+	}
+	return err
+}
+
+// interruptibleSinks wraps the sinks so that they return ctx's error once it is done.
+func interruptibleSinks(
+	ctx context.Context, nodeSink sdtypes.StateNodeSink, ipldSink sdtypes.IPLDSink,
+) (sdtypes.StateNodeSink, sdtypes.IPLDSink) {
+	return func(node sdtypes.StateLeafNode) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			return nodeSink(node)
+		}, func(c sdtypes.IPLD) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			return ipldSink(c)
+		}
+}
+
+func (s *Service) canonicalHeader(height uint64) (*types.Header, error) {
+	hash := rawdb.ReadCanonicalHash(s.ethDB, height)
+	header := rawdb.ReadHeader(s.ethDB, hash, height)
+	if header == nil {
+		return nil, fmt.Errorf("unable to read canonical header at height %d", height)
+	}
+	return header, nil
+}
+
+// StateDiffRangeParams specifies a range of blocks to write state diffs for. Both ends of the range
+// are inclusive.
+type StateDiffRangeParams struct {
+	WatchedAddresses []common.Address
+	Start            uint64
+	End              uint64
+	Workers          uint
+}
+
+// CreateStateDiffs publishes, for each canonical block in the range, its header and the difference
+// between its state and that of its parent. The genesis block is diffed against the empty state.
+// If ctx is cancelled, the diffs already committed are kept, and the one being written is rolled
+// back.
+func (s *Service) CreateStateDiffs(ctx context.Context, params StateDiffRangeParams) error {
+	if params.End < params.Start {
+		return fmt.Errorf("invalid block range %d to %d", params.Start, params.End)
+	}
+	log.WithField("start", params.Start).WithField("end", params.End).Info("Creating state diffs")
+
+	for height := params.Start; ; height++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		header, err := s.canonicalHeader(height)
+		if err != nil {
+			return err
+		}
+		parentRoot := types.EmptyRootHash
+		if height > 0 {
+			parent := rawdb.ReadHeader(s.ethDB, header.ParentHash, height-1)
+			if parent == nil {
+				return fmt.Errorf("unable to read parent header %s at height %d", header.ParentHash, height-1)
+			}
+			parentRoot = parent.Root
+		}
+		if err = s.writeStateDiff(ctx, parentRoot, header, params.WatchedAddresses, params.Workers); err != nil {
+			return fmt.Errorf("failed to write state diff at height %d: %w", height, err)
+		}
+		log.WithField("height", height).Debug("State diff complete")
+		if height == params.End {
+			return nil
+		}
+	}
+}
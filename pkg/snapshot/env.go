@@ -17,11 +17,39 @@ package snapshot
 
 // ENV variables
 const (
-	SNAPSHOT_BLOCK_HEIGHT  = "SNAPSHOT_BLOCK_HEIGHT"
-	SNAPSHOT_WORKERS       = "SNAPSHOT_WORKERS"
-	SNAPSHOT_RECOVERY_FILE = "SNAPSHOT_RECOVERY_FILE"
-	SNAPSHOT_MODE          = "SNAPSHOT_MODE"
-	SNAPSHOT_ACCOUNTS      = "SNAPSHOT_ACCOUNTS"
+	SNAPSHOT_BLOCK_HEIGHT        = "SNAPSHOT_BLOCK_HEIGHT"
+	SNAPSHOT_BLOCK_HEIGHTS       = "SNAPSHOT_BLOCK_HEIGHTS"
+	SNAPSHOT_FROM_HEIGHT         = "SNAPSHOT_FROM_HEIGHT"
+	SNAPSHOT_BLOCK_HASH          = "SNAPSHOT_BLOCK_HASH"
+	SNAPSHOT_BLOCK_TIME          = "SNAPSHOT_BLOCK_TIME"
+	SNAPSHOT_BLOCK_TAG           = "SNAPSHOT_BLOCK_TAG"
+	SNAPSHOT_STATE_ROOT          = "SNAPSHOT_STATE_ROOT"
+	SNAPSHOT_HEADER_FILE         = "SNAPSHOT_HEADER_FILE"
+	SNAPSHOT_CHECK_ONLY          = "SNAPSHOT_CHECK_ONLY"
+	SNAPSHOT_VERIFY              = "SNAPSHOT_VERIFY"
+	SNAPSHOT_DRY_RUN             = "SNAPSHOT_DRY_RUN"
+	SNAPSHOT_EXISTING            = "SNAPSHOT_EXISTING"
+	SNAPSHOT_WORKERS             = "SNAPSHOT_WORKERS"
+	SNAPSHOT_BATCH_SIZE          = "SNAPSHOT_BATCH_SIZE"
+	SNAPSHOT_BATCH_BYTES         = "SNAPSHOT_BATCH_BYTES"
+	SNAPSHOT_WRITERS             = "SNAPSHOT_WRITERS"
+	SNAPSHOT_QUEUE_LENGTH        = "SNAPSHOT_QUEUE_LENGTH"
+	SNAPSHOT_RECOVERY_FILE       = "SNAPSHOT_RECOVERY_FILE"
+	SNAPSHOT_RECOVERY_MISMATCH   = "SNAPSHOT_RECOVERY_MISMATCH"
+	SNAPSHOT_RECOVERY_STORE      = "SNAPSHOT_RECOVERY_STORE"
+	SNAPSHOT_COMMIT_INTERVAL     = "SNAPSHOT_COMMIT_INTERVAL"
+	SNAPSHOT_CHECKPOINT_INTERVAL = "SNAPSHOT_CHECKPOINT_INTERVAL"
+	SNAPSHOT_STORAGE_SPLIT       = "SNAPSHOT_STORAGE_SPLIT"
+	SNAPSHOT_DEDUP_SIZE          = "SNAPSHOT_DEDUP_SIZE"
+	SNAPSHOT_RESULT_FILE         = "SNAPSHOT_RESULT_FILE"
+	SNAPSHOT_MODE                = "SNAPSHOT_MODE"
+	SNAPSHOT_ACCOUNTS            = "SNAPSHOT_ACCOUNTS"
+
+	STATEDIFF_START_HEIGHT = "STATEDIFF_START_HEIGHT"
+	STATEDIFF_END_HEIGHT   = "STATEDIFF_END_HEIGHT"
+
+	BLOCKS_START_HEIGHT = "BLOCKS_START_HEIGHT"
+	BLOCKS_END_HEIGHT   = "BLOCKS_END_HEIGHT"
 
 	LOG_LEVEL = "LOG_LEVEL"
 	LOG_FILE  = "LOG_FILE"
@@ -55,11 +83,39 @@ const (
 
 // TOML bindings
 const (
-	SNAPSHOT_BLOCK_HEIGHT_TOML  = "snapshot.blockHeight"
-	SNAPSHOT_WORKERS_TOML       = "snapshot.workers"
-	SNAPSHOT_RECOVERY_FILE_TOML = "snapshot.recoveryFile"
-	SNAPSHOT_MODE_TOML          = "snapshot.mode"
-	SNAPSHOT_ACCOUNTS_TOML      = "snapshot.accounts"
+	SNAPSHOT_BLOCK_HEIGHT_TOML        = "snapshot.blockHeight"
+	SNAPSHOT_BLOCK_HEIGHTS_TOML       = "snapshot.blockHeights"
+	SNAPSHOT_FROM_HEIGHT_TOML         = "snapshot.fromHeight"
+	SNAPSHOT_BLOCK_HASH_TOML          = "snapshot.blockHash"
+	SNAPSHOT_BLOCK_TIME_TOML          = "snapshot.blockTime"
+	SNAPSHOT_BLOCK_TAG_TOML           = "snapshot.blockTag"
+	SNAPSHOT_STATE_ROOT_TOML          = "snapshot.stateRoot"
+	SNAPSHOT_HEADER_FILE_TOML         = "snapshot.headerFile"
+	SNAPSHOT_CHECK_ONLY_TOML          = "snapshot.checkOnly"
+	SNAPSHOT_VERIFY_TOML              = "snapshot.verify"
+	SNAPSHOT_DRY_RUN_TOML             = "snapshot.dryRun"
+	SNAPSHOT_EXISTING_TOML            = "snapshot.existing"
+	SNAPSHOT_WORKERS_TOML             = "snapshot.workers"
+	SNAPSHOT_BATCH_SIZE_TOML          = "snapshot.batchSize"
+	SNAPSHOT_BATCH_BYTES_TOML         = "snapshot.batchBytes"
+	SNAPSHOT_WRITERS_TOML             = "snapshot.writers"
+	SNAPSHOT_QUEUE_LENGTH_TOML        = "snapshot.queueLength"
+	SNAPSHOT_RECOVERY_FILE_TOML       = "snapshot.recoveryFile"
+	SNAPSHOT_RECOVERY_MISMATCH_TOML   = "snapshot.recoveryMismatch"
+	SNAPSHOT_RECOVERY_STORE_TOML      = "snapshot.recoveryStore"
+	SNAPSHOT_COMMIT_INTERVAL_TOML     = "snapshot.commitInterval"
+	SNAPSHOT_CHECKPOINT_INTERVAL_TOML = "snapshot.checkpointInterval"
+	SNAPSHOT_STORAGE_SPLIT_TOML       = "snapshot.storageSplit"
+	SNAPSHOT_DEDUP_SIZE_TOML          = "snapshot.dedupSize"
+	SNAPSHOT_RESULT_FILE_TOML         = "snapshot.resultFile"
+	SNAPSHOT_MODE_TOML                = "snapshot.mode"
+	SNAPSHOT_ACCOUNTS_TOML            = "snapshot.accounts"
+
+	STATEDIFF_START_HEIGHT_TOML = "statediff.startHeight"
+	STATEDIFF_END_HEIGHT_TOML   = "statediff.endHeight"
+
+	BLOCKS_START_HEIGHT_TOML = "blocks.startHeight"
+	BLOCKS_END_HEIGHT_TOML   = "blocks.endHeight"
 
 	LOG_LEVEL_TOML = "log.level"
 	LOG_FILE_TOML  = "log.file"
@@ -93,11 +149,39 @@ const (
 
 // CLI flags
 const (
-	SNAPSHOT_BLOCK_HEIGHT_CLI  = "block-height"
-	SNAPSHOT_WORKERS_CLI       = "workers"
-	SNAPSHOT_RECOVERY_FILE_CLI = "recovery-file"
-	SNAPSHOT_MODE_CLI          = "snapshot-mode"
-	SNAPSHOT_ACCOUNTS_CLI      = "snapshot-accounts"
+	SNAPSHOT_BLOCK_HEIGHT_CLI        = "block-height"
+	SNAPSHOT_BLOCK_HEIGHTS_CLI       = "block-heights"
+	SNAPSHOT_FROM_HEIGHT_CLI         = "from-height"
+	SNAPSHOT_BLOCK_HASH_CLI          = "block-hash"
+	SNAPSHOT_BLOCK_TIME_CLI          = "block-time"
+	SNAPSHOT_BLOCK_TAG_CLI           = "block-tag"
+	SNAPSHOT_STATE_ROOT_CLI          = "state-root"
+	SNAPSHOT_HEADER_FILE_CLI         = "header-file"
+	SNAPSHOT_CHECK_ONLY_CLI          = "check-only"
+	SNAPSHOT_VERIFY_CLI              = "verify"
+	SNAPSHOT_DRY_RUN_CLI             = "dry-run"
+	SNAPSHOT_EXISTING_CLI            = "existing"
+	SNAPSHOT_WORKERS_CLI             = "workers"
+	SNAPSHOT_BATCH_SIZE_CLI          = "batch-size"
+	SNAPSHOT_BATCH_BYTES_CLI         = "batch-bytes"
+	SNAPSHOT_WRITERS_CLI             = "writers"
+	SNAPSHOT_QUEUE_LENGTH_CLI        = "queue-length"
+	SNAPSHOT_RECOVERY_FILE_CLI       = "recovery-file"
+	SNAPSHOT_RECOVERY_MISMATCH_CLI   = "recovery-mismatch"
+	SNAPSHOT_RECOVERY_STORE_CLI      = "recovery-store"
+	SNAPSHOT_COMMIT_INTERVAL_CLI     = "commit-interval"
+	SNAPSHOT_CHECKPOINT_INTERVAL_CLI = "checkpoint-interval"
+	SNAPSHOT_STORAGE_SPLIT_CLI       = "storage-split"
+	SNAPSHOT_DEDUP_SIZE_CLI          = "dedup-size"
+	SNAPSHOT_RESULT_FILE_CLI         = "result-file"
+	SNAPSHOT_MODE_CLI                = "snapshot-mode"
+	SNAPSHOT_ACCOUNTS_CLI            = "snapshot-accounts"
+
+	STATEDIFF_START_HEIGHT_CLI = "start-height"
+	STATEDIFF_END_HEIGHT_CLI   = "end-height"
+
+	BLOCKS_START_HEIGHT_CLI = "start-height"
+	BLOCKS_END_HEIGHT_CLI   = "end-height"
 
 	LOG_LEVEL_CLI = "log-level"
 	LOG_FILE_CLI  = "log-file"
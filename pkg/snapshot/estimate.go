@@ -0,0 +1,370 @@
+// Copyright © 2024 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultEstimateSamples    = 16
+	defaultEstimateSampleSize = 64
+	// storage tries are read up to this many slots, and extrapolated beyond it
+	estimateMaxSlots = 1024
+
+	// approximate sizes of the rows written for each record, excluding IPLD content
+	stateRowSize   = 420
+	storageRowSize = 330
+	ipldRowSize    = 80
+	headerRowSize  = 1000
+)
+
+// EstimateParams controls how densely the state is sampled for an estimate.
+type EstimateParams struct {
+	// Samples is the number of places in each subtrie at which accounts are read.
+	Samples uint
+	// SampleSize is the number of consecutive accounts read at each place.
+	SampleSize uint
+}
+
+// Estimate holds the expected size of a snapshot, extrapolated from a sample of the state.
+type Estimate struct {
+	Height    uint64
+	StateRoot common.Hash
+	// FlatSnapshot is set if storage was sampled from geth's flat snapshot instead of the tries.
+	FlatSnapshot bool
+
+	Subtries []SubtrieEstimate
+	// Total holds the sum of the subtrie estimates.
+	Total SubtrieEstimate
+	// TableBytes is the expected output size for each table.
+	TableBytes map[string]uint64
+	// Duration is the expected time to traverse the state with the given number of workers.
+	Duration time.Duration
+}
+
+// SubtrieEstimate holds the expected counts for a range of the state trie's key space.
+type SubtrieEstimate struct {
+	Start, End   common.Hash
+	Accounts     uint64
+	StorageSlots uint64
+	StateNodes   uint64
+	StorageNodes uint64
+	CodeNodes    uint64
+	IPLDs        uint64
+	IPLDBytes    uint64
+}
+
+func (e *SubtrieEstimate) add(o SubtrieEstimate) {
+	e.Accounts += o.Accounts
+	e.StorageSlots += o.StorageSlots
+	e.StateNodes += o.StateNodes
+	e.StorageNodes += o.StorageNodes
+	e.CodeNodes += o.CodeNodes
+	e.IPLDs += o.IPLDs
+	e.IPLDBytes += o.IPLDBytes
+}
+
+// trieSample is the result of reading a run of consecutive leaves from a trie.
+type trieSample struct {
+	leaves uint64
+	// nodes and bytes count the hashed nodes following the first leaf, so that nodes above the
+	// sampled range are excluded, and following counts the leaves after the first
+	nodes, bytes, following uint64
+	// span is the fraction of the key space covered
+	span float64
+}
+
+func (s *trieSample) add(o trieSample) {
+	s.leaves += o.leaves
+	s.nodes += o.nodes
+	s.bytes += o.bytes
+	s.following += o.following
+	s.span += o.span
+}
+
+// nodesPerLeaf returns the average number and size of hashed nodes per leaf.
+func (s *trieSample) nodesPerLeaf() (float64, float64) {
+	if s.following == 0 || s.nodes == 0 {
+		return 1, 0
+	}
+	return float64(s.nodes) / float64(s.following), float64(s.bytes) / float64(s.nodes)
+}
+
+// EstimateSnapshot estimates the size of the snapshot described by params, without writing
+// anything. Each subtrie to be processed by a worker is sampled at random places, and the counts
+// are extrapolated from the density of leaves found there.
+func (s *Service) EstimateSnapshot(params SnapshotParams, eparams EstimateParams) ([]*Estimate, error) {
+	headers, err := s.ResolveHeaders(params)
+	if err != nil {
+		return nil, err
+	}
+	if eparams.Samples == 0 {
+		eparams.Samples = defaultEstimateSamples
+	}
+	if eparams.SampleSize == 0 {
+		eparams.SampleSize = defaultEstimateSampleSize
+	}
+	workers := params.Workers
+	if workers == 0 {
+		workers = 1
+	}
+	var estimates []*Estimate
+	for _, header := range headers {
+		estimate, err := s.estimate(header, workers, eparams)
+		if err != nil {
+			return nil, err
+		}
+		estimates = append(estimates, estimate)
+	}
+	return estimates, nil
+}
+
+func (s *Service) estimate(header *types.Header, workers uint, params EstimateParams) (*Estimate, error) {
+	tr, err := trie.NewStateTrie(trie.StateTrieID(header.Root), s.stateDB.TrieDB())
+	if err != nil {
+		return nil, fmt.Errorf("state root %s not found in ethdb: %w", header.Root, err)
+	}
+	estimate := &Estimate{
+		Height:       header.Number.Uint64(),
+		StateRoot:    header.Root,
+		FlatSnapshot: hasFlatSnapshot(s.ethDB, header.Root),
+	}
+	log.WithField("height", estimate.Height).WithField("flatSnapshot", estimate.FlatSnapshot).
+		Info("Estimating snapshot size")
+
+	began := time.Now()
+	var visited uint64
+	rng := rand.New(rand.NewSource(int64(header.Root.Big().Uint64())))
+	var stateSample, storageSample trieSample
+	var accounts, contracts, slots, codeBytes uint64
+	// per subtrie leaf density, as leaves and span
+	subtrieSamples := make([]trieSample, workers)
+	for i := uint(0); i < workers; i++ {
+		lo, hi := float64(i)/float64(workers), float64(i+1)/float64(workers)
+		for j := uint(0); j < params.Samples; j++ {
+			start := keyAt(lo + rng.Float64()*(hi-lo))
+			sample, err := sampleTrie(tr, start, params.SampleSize, func(key, value []byte) error {
+				account, err := types.FullAccount(value)
+				if err != nil {
+					return fmt.Errorf("invalid account %x: %w", key, err)
+				}
+				accounts++
+				if !bytes.Equal(account.CodeHash, emptyCodeHash) {
+					contracts++
+					codeBytes += uint64(len(rawdb.ReadCode(s.ethDB, common.BytesToHash(account.CodeHash))))
+				}
+				if account.Root == types.EmptyRootHash {
+					return nil
+				}
+				if estimate.FlatSnapshot {
+					count, read, err := s.countFlatStorage(common.BytesToHash(key))
+					slots += count
+					visited += read
+					return err
+				}
+				sample, err := s.sampleStorage(header.Root, common.BytesToHash(key), account.Root)
+				storageSample.add(sample)
+				slots += extrapolate(sample.leaves, sample.span, 1)
+				visited += sample.leaves + sample.nodes
+				return err
+			})
+			if err != nil {
+				return nil, err
+			}
+			stateSample.add(sample)
+			subtrieSamples[i].add(sample)
+			visited += sample.leaves + sample.nodes
+		}
+	}
+
+	stateRatio, stateNodeSize := stateSample.nodesPerLeaf()
+	storageRatio, storageNodeSize := stateRatio, stateNodeSize
+	if storageSample.following > 0 {
+		storageRatio, storageNodeSize = storageSample.nodesPerLeaf()
+	}
+	var slotsPerAccount, contractsPerAccount, codeSize float64
+	if accounts > 0 {
+		slotsPerAccount = float64(slots) / float64(accounts)
+		contractsPerAccount = float64(contracts) / float64(accounts)
+	}
+	if contracts > 0 {
+		codeSize = float64(codeBytes) / float64(contracts)
+	}
+	for i, sample := range subtrieSamples {
+		sub := SubtrieEstimate{
+			Start: common.BytesToHash(keyAt(float64(i) / float64(workers))),
+			End:   common.BytesToHash(keyAt(float64(i+1) / float64(workers))),
+		}
+		sub.Accounts = extrapolate(sample.leaves, sample.span, 1/float64(workers))
+		sub.StorageSlots = uint64(float64(sub.Accounts) * slotsPerAccount)
+		sub.StateNodes = uint64(float64(sub.Accounts) * stateRatio)
+		sub.StorageNodes = uint64(float64(sub.StorageSlots) * storageRatio)
+		// identical code is only written once, so this is an upper bound
+		sub.CodeNodes = uint64(float64(sub.Accounts) * contractsPerAccount)
+		sub.IPLDs = sub.StateNodes + sub.StorageNodes + sub.CodeNodes
+		sub.IPLDBytes = uint64(float64(sub.StateNodes)*stateNodeSize +
+			float64(sub.StorageNodes)*storageNodeSize + float64(sub.CodeNodes)*codeSize)
+		estimate.Subtries = append(estimate.Subtries, sub)
+		estimate.Total.add(sub)
+
+		log.WithField("subtrie", i).WithField("accounts", sub.Accounts).WithField("slots", sub.StorageSlots).
+			WithField("iplds", sub.IPLDs).Debug("Subtrie estimated")
+	}
+	estimate.TableBytes = map[string]uint64{
+		"eth.header_cids":  headerRowSize,
+		"eth.state_cids":   estimate.Total.Accounts * stateRowSize,
+		"eth.storage_cids": estimate.Total.StorageSlots * storageRowSize,
+		"ipld.blocks":      estimate.Total.IPLDs*ipldRowSize + estimate.Total.IPLDBytes,
+	}
+	// the sample was read by a single worker
+	if visited > 0 {
+		perNode := time.Since(began) / time.Duration(visited)
+		estimate.Duration = perNode * time.Duration(estimate.Total.StateNodes+estimate.Total.StorageNodes) / time.Duration(workers)
+	}
+	return estimate, nil
+}
+
+// sampleTrie reads up to n consecutive leaves from the trie, starting at the given key.
+func sampleTrie(tr *trie.StateTrie, start []byte, n uint, onLeaf func(key, value []byte) error) (trieSample, error) {
+	var sample trieSample
+	it, err := tr.NodeIterator(start)
+	if err != nil {
+		return sample, err
+	}
+	var last []byte
+	var nodes, size uint64
+	for it.Next(true) {
+		if it.Leaf() {
+			if sample.leaves > 0 {
+				sample.nodes, sample.bytes = nodes, size
+				sample.following++
+			}
+			sample.leaves++
+			last = it.LeafKey()
+			if err := onLeaf(last, it.LeafBlob()); err != nil {
+				return sample, err
+			}
+			if sample.leaves == uint64(n) {
+				break
+			}
+			continue
+		}
+		if sample.leaves > 0 && it.Hash() != (common.Hash{}) {
+			nodes++
+			size += uint64(len(it.NodeBlob()))
+		}
+	}
+	if err := it.Error(); err != nil {
+		return sample, err
+	}
+	if sample.leaves == uint64(n) {
+		sample.span = keyFraction(last) - keyFraction(start)
+	} else {
+		// reached the end of the trie
+		sample.span = 1 - keyFraction(start)
+	}
+	return sample, nil
+}
+
+// sampleStorage reads the start of an account's storage trie.
+func (s *Service) sampleStorage(stateRoot, account, root common.Hash) (trieSample, error) {
+	tr, err := trie.NewStateTrie(trie.StorageTrieID(stateRoot, account, root), s.stateDB.TrieDB())
+	if err != nil {
+		return trieSample{}, err
+	}
+	return sampleTrie(tr, nil, estimateMaxSlots, func([]byte, []byte) error { return nil })
+}
+
+// countFlatStorage counts an account's storage slots in the flat snapshot, extrapolating if there
+// are more than estimateMaxSlots. It also returns the number of slots actually read.
+func (s *Service) countFlatStorage(account common.Hash) (uint64, uint64, error) {
+	prefix := append(append([]byte{}, rawdb.SnapshotStoragePrefix...), account.Bytes()...)
+	it := s.ethDB.NewIterator(prefix, nil)
+	defer it.Release()
+	var count uint64
+	var last []byte
+	for count < estimateMaxSlots && it.Next() {
+		count++
+		last = it.Key()[len(prefix):]
+	}
+	if err := it.Error(); err != nil {
+		return 0, 0, err
+	}
+	if count < estimateMaxSlots {
+		return count, count, nil
+	}
+	return extrapolate(count, keyFraction(last), 1), count, nil
+}
+
+// hasFlatSnapshot reports whether geth's flat snapshot is complete and matches the state root.
+func hasFlatSnapshot(db ethdb.KeyValueReader, root common.Hash) bool {
+	if rawdb.ReadSnapshotDisabled(db) || rawdb.ReadSnapshotRoot(db) != root {
+		return false
+	}
+	// mirrors the generator journal written by geth
+	var generator struct {
+		Wiping   bool
+		Done     bool
+		Marker   []byte
+		Accounts uint64
+		Slots    uint64
+		Storage  uint64
+	}
+	blob := rawdb.ReadSnapshotGenerator(db)
+	return len(blob) > 0 && rlp.DecodeBytes(blob, &generator) == nil && generator.Done
+}
+
+// extrapolate scales a count found in a span of the key space to a span of the given size.
+func extrapolate(count uint64, span, total float64) uint64 {
+	if span <= 0 {
+		return count
+	}
+	return uint64(math.Round(float64(count) * total / span))
+}
+
+// keyFraction maps a key to its position in the key space, in [0, 1).
+func keyFraction(key []byte) float64 {
+	var prefix [8]byte
+	copy(prefix[:], key)
+	return float64(binary.BigEndian.Uint64(prefix[:])) / math.Exp2(64)
+}
+
+// keyAt maps a position in the key space to a key.
+func keyAt(fraction float64) []byte {
+	key := make([]byte, common.HashLength)
+	if pos := fraction * math.Exp2(64); pos < math.Exp2(64) {
+		binary.BigEndian.PutUint64(key, uint64(pos))
+		return key
+	}
+	for i := range key {
+		key[i] = 0xff
+	}
+	return key
+}
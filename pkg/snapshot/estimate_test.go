@@ -0,0 +1,42 @@
+package snapshot_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	. "github.com/cerc-io/ipld-eth-state-snapshot/pkg/snapshot"
+	fixture "github.com/cerc-io/ipld-eth-state-snapshot/test"
+)
+
+func TestEstimateSnapshot(t *testing.T) {
+	var height uint64 = 262
+	data := doSnapshot(t, fixture.ChainA, SnapshotParams{Height: height, Workers: 4})
+	var slots int
+	for _, node := range data.StateNodes {
+		slots += len(node.StorageDiff)
+	}
+
+	runCase := func(t *testing.T, workers uint) {
+		// the service has no indexer, so would fail if anything were written
+		service, err := NewSnapshotService(openEthDB(t, fixture.ChainA), nil, "")
+		require.NoError(t, err)
+		estimates, err := service.EstimateSnapshot(SnapshotParams{Height: height, Workers: workers}, EstimateParams{})
+		require.NoError(t, err)
+		require.Len(t, estimates, 1)
+
+		estimate := estimates[0]
+		require.Equal(t, height, estimate.Height)
+		require.Len(t, estimate.Subtries, int(workers))
+		require.InDelta(t, len(data.StateNodes), estimate.Total.Accounts, float64(len(data.StateNodes))/2)
+		require.InDelta(t, slots, estimate.Total.StorageSlots, float64(slots)/2)
+		require.NotZero(t, estimate.Total.IPLDs)
+		require.NotZero(t, estimate.TableBytes["ipld.blocks"])
+		require.NotZero(t, estimate.Duration)
+	}
+
+	for _, tc := range []uint{1, 4, 16} {
+		t.Run(fmt.Sprintf("with %d subtries", tc), func(t *testing.T) { runCase(t, tc) })
+	}
+}
@@ -0,0 +1,378 @@
+// Copyright © 2024 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/cerc-io/plugeth-statediff/indexer/database/file"
+	"github.com/cerc-io/plugeth-statediff/indexer/shared/schema"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/jmoiron/sqlx"
+	log "github.com/sirupsen/logrus"
+)
+
+// ExistingPolicy says what to do when the output already holds a snapshot for a header.
+type ExistingPolicy string
+
+const (
+	// SkipExisting leaves the existing snapshot as it is.
+	SkipExisting ExistingPolicy = "skip"
+	// VerifyExisting checks that the state can be rebuilt from the existing snapshot, and fails if
+	// it cannot.
+	VerifyExisting ExistingPolicy = "verify"
+	// ReplaceExisting removes the existing snapshot and writes it again.
+	ReplaceExisting ExistingPolicy = "replace"
+)
+
+// ParseExistingPolicy parses the name of an ExistingPolicy.
+func ParseExistingPolicy(name string) (ExistingPolicy, error) {
+	switch policy := ExistingPolicy(name); policy {
+	case SkipExisting, VerifyExisting, ReplaceExisting:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown policy for existing snapshots %q", name)
+}
+
+// Output gives access to the snapshots already present in the output.
+type Output interface {
+	// ExistingSnapshot reports what has already been written for the header.
+	ExistingSnapshot(ctx context.Context, header *types.Header) (ExistingSnapshot, error)
+	// RemoveSnapshot removes the header and the state and storage written for it. IPLD blocks are
+	// left in place, since they may be shared with other snapshots.
+	RemoveSnapshot(ctx context.Context, header *types.Header) error
+}
+
+// SyncedOutput is an Output whose committed writes are not durable until it is synced. It is synced
+// before each recovery checkpoint is saved, so that a checkpoint never covers output lost in a
+// crash.
+type SyncedOutput interface {
+	Output
+	Sync() error
+}
+
+// ExistingSnapshot describes the output present for a header.
+type ExistingSnapshot struct {
+	// Header is whether the header has been written
+	Header bool
+	// State is whether any state has been written for the header
+	State bool
+}
+
+// Exists reports whether there is a snapshot, rather than just a header indexed with block data.
+func (e ExistingSnapshot) Exists() bool {
+	return e.Header && e.State
+}
+
+// SetExistingPolicy enables a check before each snapshot for one already written to output for the
+// same header, which is then handled according to policy. The VerifyExisting policy requires a
+// verifier to be set.
+func (s *Service) SetExistingPolicy(policy ExistingPolicy, output Output) {
+	s.existingPolicy = policy
+	s.output = output
+}
+
+// ExistingAction is what was done about an existing snapshot.
+type ExistingAction string
+
+const (
+	// NoExisting means no snapshot was found, or none was looked for.
+	NoExisting ExistingAction = ""
+	// ResumedExisting means an interrupted snapshot is resumed from its recovery file.
+	ResumedExisting ExistingAction = "resumed"
+	// SkippedExisting means the existing snapshot was left as it is.
+	SkippedExisting ExistingAction = "skipped"
+	// VerifiedExisting means the existing snapshot was verified and left as it is.
+	VerifiedExisting ExistingAction = "verified"
+	// ReplacedExisting means the existing snapshot was removed and is written again.
+	ReplacedExisting ExistingAction = "replaced"
+)
+
+// preflight checks for an existing snapshot of the header and applies the configured policy to it.
+// The snapshot only needs to be written if the returned action is not skipped or verified.
+func (s *Service) preflight(ctx context.Context, header *types.Header, recoveryFile string) (ExistingAction, error) {
+	if s.output == nil {
+		return NoExisting, nil
+	}
+	logger := log.WithField("height", header.Number).WithField("hash", header.Hash())
+	rows, err := s.recovery.Load(ctx, recoveryFile)
+	if err != nil {
+		return NoExisting, fmt.Errorf("failed to load recovery checkpoint %s: %w", recoveryFile, err)
+	}
+	if rows != nil {
+		logger.WithField("file", recoveryFile).Info("Resuming interrupted snapshot")
+		return ResumedExisting, nil
+	}
+	existing, err := s.output.ExistingSnapshot(ctx, header)
+	if err != nil {
+		return NoExisting, fmt.Errorf("failed to check for existing snapshot: %w", err)
+	}
+	if !existing.Exists() {
+		return NoExisting, nil
+	}
+
+	policy := s.existingPolicy
+	// an incomplete snapshot cannot be used, and has no recovery file to resume from
+	if s.catalog != nil {
+		incomplete, err := s.catalog.IsIncomplete(ctx, header)
+		if err != nil {
+			return NoExisting, err
+		}
+		if incomplete {
+			logger.Warn("Existing snapshot is incomplete")
+			policy = ReplaceExisting
+		}
+	}
+	switch policy {
+	case SkipExisting:
+		logger.Info("Snapshot already exists, skipping")
+		return SkippedExisting, nil
+	case VerifyExisting:
+		if s.verifier == nil {
+			return NoExisting, fmt.Errorf("no source to verify existing snapshot")
+		}
+		logger.Info("Snapshot already exists, verifying")
+		if err := VerifyStateRoot(ctx, s.verifier, header.Root); err != nil {
+			return NoExisting, fmt.Errorf("verification of existing snapshot at height %d failed: %w", header.Number, err)
+		}
+		return VerifiedExisting, nil
+	case ReplaceExisting:
+		logger.Info("Snapshot already exists, replacing")
+		if err := s.output.RemoveSnapshot(ctx, header); err != nil {
+			return NoExisting, fmt.Errorf("failed to remove existing snapshot: %w", err)
+		}
+		return ReplacedExisting, nil
+	}
+	return NoExisting, fmt.Errorf("unknown policy for existing snapshots %q", policy)
+}
+
+// FileOutput reads the CSV files written in file output mode.
+type FileOutput struct {
+	dir string
+}
+
+func NewFileOutput(outputDir string) *FileOutput {
+	return &FileOutput{dir: outputDir}
+}
+
+// Sync flushes the CSV files written to the output directory to disk.
+func (o *FileOutput) Sync() error {
+	paths, err := filepath.Glob(filepath.Join(o.dir, "*.csv"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if err = syncFile(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func syncFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+func (o *FileOutput) ExistingSnapshot(_ context.Context, header *types.Header) (ExistingSnapshot, error) {
+	hash := header.Hash().String()
+	var ret ExistingSnapshot
+	var err error
+	ret.Header, err = o.anyRow(&schema.TableHeader, "block_hash", hash)
+	if err != nil || !ret.Header {
+		return ret, err
+	}
+	ret.State, err = o.anyRow(&schema.TableStateNode, "header_id", hash)
+	return ret, err
+}
+
+// anyRow reports whether the table file has a row with the given value in a column.
+func (o *FileOutput) anyRow(table *schema.Table, column, value string) (bool, error) {
+	index, err := columnIndex(table, column)
+	if err != nil {
+		return false, err
+	}
+	in, err := os.Open(file.TableFilePath(o.dir, table.Name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer in.Close()
+
+	reader := csv.NewReader(in)
+	reader.FieldsPerRecord = len(table.Columns)
+	reader.ReuseRecord = true
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("failed to read %s: %w", table.Name, err)
+		}
+		if row[index] == value {
+			return true, nil
+		}
+	}
+}
+
+func (o *FileOutput) RemoveSnapshot(_ context.Context, header *types.Header) error {
+	hash := header.Hash().String()
+	for _, rm := range []struct {
+		table  *schema.Table
+		column string
+	}{
+		{&schema.TableHeader, "block_hash"},
+		{&schema.TableStateNode, "header_id"},
+		{&schema.TableStorageNode, "header_id"},
+	} {
+		removed, err := o.removeRows(rm.table, rm.column, hash)
+		if err != nil {
+			return err
+		}
+		log.WithField("table", rm.table.Name).WithField("rows", removed).Debug("Removed rows of existing snapshot")
+	}
+	return nil
+}
+
+// removeRows removes the rows of a table file with the given value in a column. The file is
+// rewritten in place, since the file indexer may hold it open for appending.
+func (o *FileOutput) removeRows(table *schema.Table, column, value string) (int, error) {
+	index, err := columnIndex(table, column)
+	if err != nil {
+		return 0, err
+	}
+	path := file.TableFilePath(o.dir, table.Name)
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer f.Close()
+
+	// copy the rows to keep to a temporary file
+	tmp, err := os.CreateTemp(o.dir, ".rewrite-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	reader := csv.NewReader(f)
+	reader.FieldsPerRecord = len(table.Columns)
+	writer := csv.NewWriter(tmp)
+	removed := 0
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to read %s: %w", table.Name, err)
+		}
+		if row[index] == value {
+			removed++
+			continue
+		}
+		if err = writer.Write(row); err != nil {
+			return 0, err
+		}
+	}
+	writer.Flush()
+	if err = writer.Error(); err != nil || removed == 0 {
+		return 0, err
+	}
+
+	if _, err = tmp.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	if err = f.Truncate(0); err != nil {
+		return 0, err
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	if _, err = io.Copy(f, tmp); err != nil {
+		return 0, fmt.Errorf("failed to rewrite %s: %w", path, err)
+	}
+	return removed, nil
+}
+
+func columnIndex(table *schema.Table, name string) (int, error) {
+	for i, column := range table.Columns {
+		if column.Name == name {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("no column %s in table %s", name, table.Name)
+}
+
+// PgOutput reads the tables written in postgres output mode.
+type PgOutput struct {
+	db *sqlx.DB
+}
+
+const (
+	pgHeaderExistsStm = `SELECT EXISTS (SELECT 1 FROM eth.header_cids WHERE block_number = $1 AND block_hash = $2)`
+	pgStateExistsStm  = `SELECT EXISTS (SELECT 1 FROM eth.state_cids WHERE block_number = $1 AND header_id = $2)`
+
+	pgRemoveStorageStm = `DELETE FROM eth.storage_cids WHERE block_number = $1 AND header_id = $2`
+	pgRemoveStateStm   = `DELETE FROM eth.state_cids WHERE block_number = $1 AND header_id = $2`
+	pgRemoveHeaderStm  = `DELETE FROM eth.header_cids WHERE block_number = $1 AND block_hash = $2`
+)
+
+// NewPgOutput reads the database the snapshot is written to, which is not closed with it.
+func NewPgOutput(db *sqlx.DB) *PgOutput {
+	return &PgOutput{db: db}
+}
+
+func (o *PgOutput) ExistingSnapshot(ctx context.Context, header *types.Header) (ExistingSnapshot, error) {
+	var ret ExistingSnapshot
+	number, hash := header.Number.Uint64(), header.Hash().String()
+	if err := o.db.GetContext(ctx, &ret.Header, pgHeaderExistsStm, number, hash); err != nil || !ret.Header {
+		return ret, err
+	}
+	err := o.db.GetContext(ctx, &ret.State, pgStateExistsStm, number, hash)
+	return ret, err
+}
+
+func (o *PgOutput) RemoveSnapshot(ctx context.Context, header *types.Header) error {
+	number, hash := header.Number.Uint64(), header.Hash().String()
+	tx, err := o.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for _, stm := range []string{pgRemoveStorageStm, pgRemoveStateStm, pgRemoveHeaderStm} {
+		if _, err = tx.ExecContext(ctx, stm, number, hash); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
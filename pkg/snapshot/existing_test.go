@@ -0,0 +1,113 @@
+package snapshot_test
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cerc-io/plugeth-statediff/indexer"
+	"github.com/cerc-io/plugeth-statediff/indexer/database/file"
+	"github.com/cerc-io/plugeth-statediff/indexer/shared/schema"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/stretchr/testify/require"
+
+	. "github.com/cerc-io/ipld-eth-state-snapshot/pkg/snapshot"
+	fixture "github.com/cerc-io/ipld-eth-state-snapshot/test"
+)
+
+func TestExistingSnapshot(t *testing.T) {
+	edb := openEthDB(t, fixture.ChainA)
+	header := rawdb.ReadHeader(edb, rawdb.ReadCanonicalHash(edb, 1), 1)
+	dir := t.TempDir()
+	outputDir := filepath.Join(dir, "output")
+	config := file.Config{
+		Mode:                     file.CSV,
+		OutputDir:                outputDir,
+		WatchedAddressesFilePath: filepath.Join(dir, "watched-addresses.csv"),
+	}
+	_, idx, err := indexer.NewStateDiffIndexer(context.Background(), nil, DefaultNodeInfo, config, false)
+	require.NoError(t, err)
+	defer idx.Close()
+
+	output := NewFileOutput(outputDir)
+	catalog := NewFileCatalog(outputDir)
+	params := SnapshotParams{Height: 1, Workers: 4}
+	snapshot := func(policy ExistingPolicy, verifier IPLDSource) ExistingAction {
+		service, err := NewSnapshotService(edb, idx, filepath.Join(t.TempDir(), "recover.csv"))
+		require.NoError(t, err)
+		service.SetCatalog(catalog)
+		service.SetExistingPolicy(policy, output)
+		if verifier != nil {
+			service.SetVerifier(verifier)
+		}
+		results, err := service.CreateSnapshot(context.Background(), params)
+		require.NoError(t, err)
+		require.Len(t, results, 1)
+		return results[0].Existing
+	}
+	requireRows := func(headers, states, storage int) {
+		require.Equal(t, headers, countRows(t, outputDir, schema.TableHeader))
+		require.Equal(t, states, countRows(t, outputDir, schema.TableStateNode))
+		require.Equal(t, storage, countRows(t, outputDir, schema.TableStorageNode))
+	}
+
+	existing, err := output.ExistingSnapshot(context.Background(), header)
+	require.NoError(t, err)
+	require.False(t, existing.Exists())
+
+	snapshot(SkipExisting, nil)
+	existing, err = output.ExistingSnapshot(context.Background(), header)
+	require.NoError(t, err)
+	require.True(t, existing.Exists())
+	states := countRows(t, outputDir, schema.TableStateNode)
+	storage := countRows(t, outputDir, schema.TableStorageNode)
+	require.Equal(t, len(fixture.ChainA_Block1_StateNodeLeafKeys), states)
+	requireRows(1, states, storage)
+
+	t.Run("skip", func(t *testing.T) {
+		require.Equal(t, SkippedExisting, snapshot(SkipExisting, nil))
+		requireRows(1, states, storage)
+	})
+
+	t.Run("verify", func(t *testing.T) {
+		src, err := NewFileIPLDSource(outputDir)
+		require.NoError(t, err)
+		defer src.Close()
+		require.Equal(t, VerifiedExisting, snapshot(VerifyExisting, src))
+		requireRows(1, states, storage)
+
+		service, err := NewSnapshotService(edb, idx, "")
+		require.NoError(t, err)
+		service.SetExistingPolicy(VerifyExisting, output)
+		service.SetVerifier(mapSource{})
+		_, err = service.CreateSnapshot(context.Background(), params)
+		require.ErrorContains(t, err, "verification of existing snapshot")
+	})
+
+	t.Run("replace", func(t *testing.T) {
+		require.Equal(t, ReplacedExisting, snapshot(ReplaceExisting, nil))
+		requireRows(1, states, storage)
+	})
+
+	t.Run("incomplete", func(t *testing.T) {
+		require.NoError(t, catalog.MarkIncomplete(context.Background(), header, errors.New("failed")))
+		// incomplete snapshots are replaced, whatever the policy
+		require.Equal(t, ReplacedExisting, snapshot(SkipExisting, nil))
+		requireRows(1, states, storage)
+		incomplete, err := catalog.IsIncomplete(context.Background(), header)
+		require.NoError(t, err)
+		require.False(t, incomplete)
+	})
+}
+
+func countRows(t *testing.T, dir string, table schema.Table) int {
+	f, err := os.Open(file.TableFilePath(dir, table.Name))
+	require.NoError(t, err)
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	require.NoError(t, err)
+	return len(rows)
+}
@@ -0,0 +1,151 @@
+// Copyright © 2024 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/cerc-io/plugeth-statediff/indexer/database/file"
+	"github.com/cerc-io/plugeth-statediff/indexer/shared/schema"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/jmoiron/sqlx"
+)
+
+// FileIPLDSource reads the blocks written to the ipld.blocks CSV file in file output mode. They are
+// loaded into a temporary database as they are needed, so rows appended since the last read are
+// picked up.
+type FileIPLDSource struct {
+	path   string
+	tmpDir string
+	db     ethdb.Database
+
+	mtx    sync.Mutex
+	offset int64
+}
+
+// NewFileIPLDSource creates a source for the file output written to outputDir.
+func NewFileIPLDSource(outputDir string) (*FileIPLDSource, error) {
+	tmpDir, err := os.MkdirTemp("", "ipld-eth-state-snapshot-verify")
+	if err != nil {
+		return nil, err
+	}
+	db, err := rawdb.NewLevelDBDatabase(tmpDir, 256, 64, "", false)
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		return nil, err
+	}
+	return &FileIPLDSource{
+		path:   file.TableFilePath(outputDir, schema.TableIPLDBlock.Name),
+		tmpDir: tmpDir,
+		db:     db,
+	}, nil
+}
+
+func (f *FileIPLDSource) Get(_ context.Context, cid string) ([]byte, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if data, err := f.db.Get([]byte(cid)); err == nil {
+		return data, nil
+	}
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+	if data, err := f.db.Get([]byte(cid)); err == nil {
+		return data, nil
+	}
+	return nil, nil
+}
+
+// load reads the rows written since the last load.
+func (f *FileIPLDSource) load() error {
+	in, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if _, err = in.Seek(f.offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	reader := csv.NewReader(in)
+	reader.FieldsPerRecord = len(schema.TableIPLDBlock.Columns)
+	batch := f.db.NewBatch()
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", f.path, err)
+		}
+		// columns are block_number, key, data
+		data, err := hex.DecodeString(strings.TrimPrefix(row[2], `\x`))
+		if err != nil {
+			return fmt.Errorf("invalid data for block %s: %w", row[1], err)
+		}
+		if err = batch.Put([]byte(row[1]), data); err != nil {
+			return err
+		}
+		if batch.ValueSize() >= ethdb.IdealBatchSize {
+			if err = batch.Write(); err != nil {
+				return err
+			}
+			batch.Reset()
+		}
+	}
+	if err = batch.Write(); err != nil {
+		return err
+	}
+	f.offset += reader.InputOffset()
+	return nil
+}
+
+// Close removes the temporary database.
+func (f *FileIPLDSource) Close() error {
+	f.db.Close()
+	return os.RemoveAll(f.tmpDir)
+}
+
+// PgIPLDSource reads blocks from the ipld.blocks table.
+type PgIPLDSource struct {
+	db *sqlx.DB
+}
+
+const pgGetIPLDStm = `SELECT data FROM ipld.blocks WHERE key = $1 LIMIT 1`
+
+// NewPgIPLDSource reads from the database holding the snapshot output, which is not closed with it.
+func NewPgIPLDSource(db *sqlx.DB) *PgIPLDSource {
+	return &PgIPLDSource{db: db}
+}
+
+func (p *PgIPLDSource) Get(ctx context.Context, cid string) ([]byte, error) {
+	var data []byte
+	err := p.db.GetContext(ctx, &data, pgGetIPLDStm, cid)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return data, err
+}
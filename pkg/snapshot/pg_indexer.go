@@ -0,0 +1,129 @@
+// Copyright © 2024 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"strconv"
+
+	"github.com/cerc-io/plugeth-statediff/indexer"
+	"github.com/cerc-io/plugeth-statediff/indexer/database/sql"
+	"github.com/cerc-io/plugeth-statediff/indexer/shared/schema"
+	sdtypes "github.com/cerc-io/plugeth-statediff/types"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+// PgIndexer is the plugeth-statediff SQL indexer, extended to write the storage nodes of an
+// account apart from its state node, so that large storage tries can be divided among workers.
+// Its batches write through the same database transaction as those of the SQL indexer.
+type PgIndexer struct {
+	*sql.StateDiffIndexer
+	db     sql.Database
+	isDiff bool
+}
+
+// pgBatch is a batch of the SQL indexer, along with its transaction, which the SQL indexer does not
+// expose.
+type pgBatch struct {
+	*sql.BatchTx
+	tx sql.Tx
+}
+
+var _ StorageIndexer = (*PgIndexer)(nil)
+
+// NewPgIndexer creates a PgIndexer writing to db. isDiff marks the state written as an incremental
+// diff rather than a full snapshot.
+func NewPgIndexer(ctx context.Context, chainConfig *params.ChainConfig, db sql.Database, isDiff bool) (*PgIndexer, error) {
+	ind, err := sql.NewStateDiffIndexer(ctx, chainConfig, db, isDiff)
+	if err != nil {
+		return nil, err
+	}
+	return &PgIndexer{StateDiffIndexer: ind, db: db, isDiff: isDiff}, nil
+}
+
+// BeginTx begins a batch, as the SQL indexer does.
+func (pi *PgIndexer) BeginTx(number *big.Int, ctx context.Context) indexer.Batch {
+	tx := sql.NewDelayedTx(pi.db)
+	return &pgBatch{
+		BatchTx: sql.NewBatch(pi.db.InsertIPLDsStm(), ctx, number, tx),
+		tx:      tx,
+	}
+}
+
+func (pi *PgIndexer) PushHeader(batch indexer.Batch, header *types.Header, reward, td *big.Int) (string, error) {
+	return pi.StateDiffIndexer.PushHeader(unwrapBatch(batch), header, reward, td)
+}
+
+func (pi *PgIndexer) PushStateNode(batch indexer.Batch, stateNode sdtypes.StateLeafNode, headerID string) error {
+	return pi.StateDiffIndexer.PushStateNode(unwrapBatch(batch), stateNode, headerID)
+}
+
+func (pi *PgIndexer) PushIPLD(batch indexer.Batch, ipld sdtypes.IPLD) error {
+	return pi.StateDiffIndexer.PushIPLD(unwrapBatch(batch), ipld)
+}
+
+// PushStorageNodes writes storage nodes of the account with the given state leaf key, as the SQL
+// indexer writes those of a state node. Their IPLD blocks are pushed separately.
+func (pi *PgIndexer) PushStorageNodes(
+	batch indexer.Batch, stateKey []byte, nodes []sdtypes.StorageLeafNode, headerID string,
+) error {
+	b, ok := batch.(*pgBatch)
+	if !ok {
+		return fmt.Errorf("pg indexer: batch is expected to be of type %T, got %T", &pgBatch{}, batch)
+	}
+	stateKeyHex := common.BytesToHash(stateKey).String()
+	for _, node := range nodes {
+		// removed nodes are only found in diffs, which are written with their account
+		if node.Removed {
+			return fmt.Errorf("cannot write removed storage node %x apart from its account", node.LeafKey)
+		}
+		storageKey := common.BytesToHash(node.LeafKey).String()
+		if err := pi.insertStorage(b, headerID, stateKeyHex, storageKey, node.CID, node.Value); err != nil {
+			return fmt.Errorf("error writing storage node %s of account %s: %w", storageKey, stateKeyHex, err)
+		}
+	}
+	return nil
+}
+
+// insertStorage inserts a storage row with the statement or COPY the SQL indexer would use.
+func (pi *PgIndexer) insertStorage(b *pgBatch, headerID, stateKey, storageKey, cid string, value []byte) error {
+	ctx := pi.db.Context()
+	if pi.db.UseCopyFrom() {
+		number, err := strconv.ParseUint(b.BlockNumber(), 10, 64)
+		if err != nil {
+			return err
+		}
+		_, err = b.tx.CopyFrom(ctx, schema.TableStorageNode.TableName(), schema.TableStorageNode.ColumnNames(),
+			[][]interface{}{{number, headerID, stateKey, storageKey, cid, pi.isDiff, value, false}})
+		return err
+	}
+	_, err := b.tx.Exec(ctx, pi.db.InsertStorageStm(),
+		b.BlockNumber(), headerID, stateKey, storageKey, cid, pi.isDiff, value, false)
+	return err
+}
+
+// unwrapBatch returns the SQL indexer's batch within a PgIndexer batch. Other batches, such as
+// those returned by PushBlock, are passed through.
+func unwrapBatch(batch indexer.Batch) indexer.Batch {
+	if b, ok := batch.(*pgBatch); ok {
+		return b.BatchTx
+	}
+	return batch
+}
@@ -0,0 +1,124 @@
+package snapshot_test
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"path/filepath"
+	"testing"
+
+	"github.com/cerc-io/plugeth-statediff/indexer/database/sql/postgres"
+	sdtypes "github.com/cerc-io/plugeth-statediff/types"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cerc-io/ipld-eth-state-snapshot/internal/mocks"
+	. "github.com/cerc-io/ipld-eth-state-snapshot/pkg/snapshot"
+	fixture "github.com/cerc-io/ipld-eth-state-snapshot/test"
+)
+
+func newPgIndexer(t *testing.T) (*PgIndexer, *mocks.Driver, *postgres.DB) {
+	driver := mocks.NewDriver()
+	db := postgres.NewPostgresDB(driver, false)
+	idx, err := NewPgIndexer(context.Background(), nil, db, false)
+	require.NoError(t, err)
+	return idx, driver, db
+}
+
+func TestPgIndexerStorageNodes(t *testing.T) {
+	idx, driver, db := newPgIndexer(t)
+	stateKey := common.HexToHash("0x01").Bytes()
+	account := sdtypes.StateLeafNode{AccountWrapper: sdtypes.AccountWrapper{
+		LeafKey: stateKey,
+		Account: types.NewEmptyStateAccount(),
+		CID:     "state",
+	}}
+	storage := []sdtypes.StorageLeafNode{
+		{LeafKey: common.HexToHash("0x02").Bytes(), CID: "slot2", Value: []byte{2}},
+		{LeafKey: common.HexToHash("0x03").Bytes(), CID: "slot3", Value: []byte{3}},
+	}
+
+	tx := idx.BeginTx(big.NewInt(7), context.Background())
+	require.NoError(t, idx.PushStateNode(tx, account, "header"))
+	require.NoError(t, idx.PushStorageNodes(tx, stateKey, storage, "header"))
+	require.Empty(t, driver.Committed)
+	require.NoError(t, tx.Submit())
+
+	// the storage rows are committed with the state row
+	require.Len(t, driver.Committed, 1)
+	require.Len(t, driver.Rows(db.InsertStateStm()), 1)
+	rows := driver.Rows(db.InsertStorageStm())
+	require.Len(t, rows, 2)
+	for i, row := range rows {
+		require.Equal(t, []interface{}{
+			"7", "header", common.BytesToHash(stateKey).String(), common.BytesToHash(storage[i].LeafKey).String(),
+			storage[i].CID, false, storage[i].Value, false,
+		}, row)
+	}
+
+	// rows of a batch which is rolled back are not written
+	tx = idx.BeginTx(big.NewInt(7), context.Background())
+	require.NoError(t, idx.PushStorageNodes(tx, stateKey, storage, "header"))
+	tx.RollbackOnFailure(fmt.Errorf("failed"))
+	require.Len(t, driver.Committed, 1)
+
+	tx = idx.BeginTx(big.NewInt(7), context.Background())
+	removed := []sdtypes.StorageLeafNode{{LeafKey: storage[0].LeafKey, Removed: true}}
+	require.Error(t, idx.PushStorageNodes(tx, stateKey, removed, "header"))
+	tx.RollbackOnFailure(fmt.Errorf("failed"))
+}
+
+func TestPgIndexerStorageSplit(t *testing.T) {
+	edb := openEthDB(t, fixture.ChainB)
+	whole := doSnapshot(t, fixture.ChainB, SnapshotParams{Height: 32, Workers: 1})
+
+	idx, driver, db := newPgIndexer(t)
+	service, err := NewSnapshotService(edb, idx, filepath.Join(t.TempDir(), "recover.csv"))
+	require.NoError(t, err)
+	service.SetStorageSplit(1)
+	service.SetCommitInterval(2)
+	_, err = service.CreateSnapshot(context.Background(), SnapshotParams{Height: 32, Workers: 4})
+	require.NoError(t, err)
+
+	// each state and storage row is written once, and the storage rows match the builder's
+	stateRows := make(map[string]int)
+	for _, row := range driver.Rows(db.InsertStateStm()) {
+		stateRows[row[2].(string)]++
+	}
+	storage := make(map[string]map[string]struct{})
+	for key := range stateRows {
+		storage[key] = make(map[string]struct{})
+	}
+	storageRows := driver.Rows(db.InsertStorageStm())
+	for _, row := range storageRows {
+		storage[row[2].(string)][row[3].(string)] = struct{}{}
+	}
+	for key, n := range stateRows {
+		require.Equal(t, 1, n, "state node %s written %d times", key, n)
+	}
+	require.Len(t, stateRows, len(whole.StateNodes))
+	require.Equal(t, storageSets(whole), storage)
+	var slots int
+	for _, keys := range storage {
+		slots += len(keys)
+	}
+	require.Len(t, storageRows, slots)
+
+	// the storage of divided tries is committed apart from the account
+	divided := false
+	for _, tx := range driver.Committed {
+		accounts := make(map[interface{}]bool)
+		for _, s := range tx {
+			if s.SQL == db.InsertStateStm() {
+				accounts[s.Args[2]] = true
+			}
+		}
+		for _, s := range tx {
+			if s.SQL == db.InsertStorageStm() && !accounts[s.Args[2]] {
+				divided = true
+			}
+		}
+	}
+	require.True(t, divided, "no storage trie was divided")
+}
@@ -0,0 +1,174 @@
+// Copyright © 2024 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// ProgressObserver receives events as a snapshot is written. Events for subtries are sent from the
+// workers processing them, so methods may be called concurrently and should return quickly.
+type ProgressObserver interface {
+	// SubtrieStarted is called when a worker starts iterating over its subtrie.
+	SubtrieStarted(SubtrieEvent)
+	// SubtrieFinished is called when a worker has completed its subtrie. Its output is committed
+	// once the batches emitted before this are written.
+	SubtrieFinished(SubtrieEvent)
+	// Progress is called periodically while the snapshot is being written.
+	Progress(Progress)
+	// Finished is called with the final progress of the snapshot, and the error if it failed.
+	Finished(Progress, error)
+}
+
+// SubtrieEvent identifies the subtrie of a snapshot processed by one worker.
+type SubtrieEvent struct {
+	Height uint64
+	Hash   common.Hash
+	// Index is the position of the subtrie among those of the snapshot. Ranges split off from a
+	// running subtrie for an idle worker are numbered after the initial subtries.
+	Index int
+	// Start and End bound the subtrie's range of paths, as nibbles. When resuming, Start is the
+	// position restored from the recovery file. End is moved back if the rest of the range is split
+	// off, so it may differ between the start and finish of a subtrie.
+	Start, End []byte
+	// Account is the leaf key of the account whose storage trie the range is in, or empty if it is
+	// a range of the state trie.
+	Account common.Hash
+}
+
+// Progress holds the counts of what has been written for a snapshot so far.
+type Progress struct {
+	Height uint64
+	Hash   common.Hash
+
+	StateNodes   uint64
+	StorageNodes uint64
+	IPLDs        uint64
+	CodeNodes    uint64
+	// Bytes is the size of the IPLD block data written, which makes up most of the output.
+	Bytes uint64
+	// Percent is the estimated completion of the snapshot, averaged over its subtries. When
+	// resuming, it measures the work remaining at the start of the run.
+	Percent float64
+	Elapsed time.Duration
+}
+
+// SetProgressObserver sets an observer to receive the progress of each snapshot, with counts sent
+// at the given interval. If interval is 0, counts are only sent when a snapshot is finished.
+func (s *Service) SetProgressObserver(observer ProgressObserver, interval time.Duration) {
+	s.progress = observer
+	s.progressInterval = interval
+}
+
+// nodeCounts counts the records written for a snapshot.
+type nodeCounts struct {
+	state, storage, iplds, codes, bytes atomic.Uint64
+}
+
+// snapshotProgress reports the progress of a snapshot to an observer.
+type snapshotProgress struct {
+	observer ProgressObserver
+	header   *types.Header
+	tracker  *iteratorTracker
+	counts   *nodeCounts
+	started  time.Time
+}
+
+func newSnapshotProgress(
+	observer ProgressObserver, header *types.Header, tracker *iteratorTracker, counts *nodeCounts,
+) *snapshotProgress {
+	p := &snapshotProgress{
+		observer: observer,
+		header:   header,
+		tracker:  tracker,
+		counts:   counts,
+		started:  time.Now(),
+	}
+	tracker.onStart = func(it *trackedIterator) {
+		observer.SubtrieStarted(p.subtrieEvent(it))
+	}
+	tracker.onFinish = func(it *trackedIterator) {
+		observer.SubtrieFinished(p.subtrieEvent(it))
+	}
+	return p
+}
+
+func (p *snapshotProgress) subtrieEvent(it *trackedIterator) SubtrieEvent {
+	event := SubtrieEvent{
+		Height: p.header.Number.Uint64(),
+		Hash:   p.header.Hash(),
+		Index:  it.index,
+		Start:  it.startPath,
+		End:    it.endPath,
+	}
+	if it.owner != nil {
+		event.Account = common.BytesToHash(it.owner.LeafKey)
+	}
+	return event
+}
+
+func (p *snapshotProgress) current(percent float64) Progress {
+	return Progress{
+		Height:       p.header.Number.Uint64(),
+		Hash:         p.header.Hash(),
+		StateNodes:   p.counts.state.Load(),
+		StorageNodes: p.counts.storage.Load(),
+		IPLDs:        p.counts.iplds.Load(),
+		CodeNodes:    p.counts.codes.Load(),
+		Bytes:        p.counts.bytes.Load(),
+		Percent:      percent,
+		Elapsed:      time.Since(p.started),
+	}
+}
+
+// run sends the progress to the observer at each interval, until the returned function is called.
+func (p *snapshotProgress) run(interval time.Duration) (stop func()) {
+	if interval == 0 {
+		return func() {}
+	}
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.observer.Progress(p.current(p.tracker.Percent()))
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-exited
+	}
+}
+
+// finish sends the final progress to the observer.
+func (p *snapshotProgress) finish(err error) {
+	percent := 100.0
+	if err != nil {
+		percent = p.tracker.Percent()
+	}
+	p.observer.Finished(p.current(percent), err)
+}
@@ -0,0 +1,81 @@
+package snapshot_test
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/cerc-io/ipld-eth-state-snapshot/internal/mocks"
+	. "github.com/cerc-io/ipld-eth-state-snapshot/pkg/snapshot"
+	fixture "github.com/cerc-io/ipld-eth-state-snapshot/test"
+)
+
+type progressRecorder struct {
+	sync.Mutex
+	started, finished []SubtrieEvent
+	progress          []Progress
+	final             *Progress
+	err               error
+}
+
+func (r *progressRecorder) SubtrieStarted(e SubtrieEvent) {
+	r.Lock()
+	defer r.Unlock()
+	r.started = append(r.started, e)
+}
+
+func (r *progressRecorder) SubtrieFinished(e SubtrieEvent) {
+	r.Lock()
+	defer r.Unlock()
+	r.finished = append(r.finished, e)
+}
+
+func (r *progressRecorder) Progress(p Progress) {
+	r.Lock()
+	defer r.Unlock()
+	r.progress = append(r.progress, p)
+}
+
+func (r *progressRecorder) Finished(p Progress, err error) {
+	r.Lock()
+	defer r.Unlock()
+	r.final, r.err = &p, err
+}
+
+func TestSnapshotProgress(t *testing.T) {
+	edb := openEthDB(t, fixture.ChainA)
+	idx := mocks.NewIndexer(t)
+	service, err := NewSnapshotService(edb, idx, filepath.Join(t.TempDir(), "recover.csv"))
+	require.NoError(t, err)
+	recorder := &progressRecorder{}
+	service.SetProgressObserver(recorder, time.Millisecond)
+
+	workers := 4
+	_, err = service.CreateSnapshot(context.Background(), SnapshotParams{Height: 1, Workers: uint(workers)})
+	require.NoError(t, err)
+	// ranges may be split off for idle workers, which start and finish like the initial subtries
+	require.GreaterOrEqual(t, len(recorder.started), workers)
+	require.Len(t, recorder.finished, len(recorder.started))
+	indexes := make(map[int]bool)
+	for _, e := range recorder.finished {
+		require.Equal(t, uint64(1), e.Height)
+		indexes[e.Index] = true
+	}
+	require.Len(t, indexes, len(recorder.started))
+
+	require.NotNil(t, recorder.final)
+	require.NoError(t, recorder.err)
+	final := *recorder.final
+	require.Equal(t, uint64(len(fixture.ChainA_Block1_StateNodeLeafKeys)), final.StateNodes)
+	require.Equal(t, uint64(len(idx.IPLDs)), final.IPLDs)
+	require.NotZero(t, final.Bytes)
+	require.Equal(t, 100.0, final.Percent)
+	for _, p := range recorder.progress {
+		require.LessOrEqual(t, p.StateNodes, final.StateNodes)
+		require.LessOrEqual(t, p.Percent, 100.0)
+	}
+}
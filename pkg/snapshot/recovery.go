@@ -0,0 +1,279 @@
+// Copyright © 2024 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// recoveryVersion is the version of the recovery file format written. Version 1 files hold only
+// iterator positions, with no identity rows, and files before version 3 do not record the start of
+// each range.
+const recoveryVersion = 3
+
+// Recovery file identity rows. Their first field is a key starting with '#', which can't be
+// mistaken for the hex path starting a position row.
+const (
+	recoveryVersionKey = "#version"
+	recoveryRootKey    = "#state_root"
+	recoveryHashKey    = "#block_hash"
+	recoveryWatchedKey = "#watched_addresses"
+	recoveryWorkersKey = "#workers"
+	recoveryOutputKey  = "#output"
+)
+
+// ErrRecoveryMismatch is returned when a recovery file was saved for a different snapshot, and the
+// RecoveryMismatchPolicy is to fail.
+var ErrRecoveryMismatch = errors.New("recovery file does not match snapshot")
+
+// RecoveryMismatchPolicy says what to do when a recovery file was saved for a different snapshot,
+// or by a version which recorded no snapshot identity.
+type RecoveryMismatchPolicy string
+
+const (
+	// FailOnMismatch refuses to run the snapshot.
+	FailOnMismatch RecoveryMismatchPolicy = "fail"
+	// RestartOnMismatch removes the recovery file and writes the snapshot from the start.
+	RestartOnMismatch RecoveryMismatchPolicy = "restart"
+	// ResumeOnMismatch resumes from the positions in the recovery file regardless.
+	ResumeOnMismatch RecoveryMismatchPolicy = "resume"
+)
+
+// ParseRecoveryMismatchPolicy parses the name of a RecoveryMismatchPolicy.
+func ParseRecoveryMismatchPolicy(name string) (RecoveryMismatchPolicy, error) {
+	switch policy := RecoveryMismatchPolicy(name); policy {
+	case FailOnMismatch, RestartOnMismatch, ResumeOnMismatch:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown policy for mismatched recovery files %q", name)
+}
+
+// SetRecoveryMismatchPolicy sets what to do when the recovery file was saved for a different
+// snapshot. The default is to fail.
+func (s *Service) SetRecoveryMismatchPolicy(policy RecoveryMismatchPolicy) {
+	s.recoveryMismatch = policy
+}
+
+// recoveryIdentity identifies the snapshot a recovery file was saved for, so that its positions are
+// not applied to a different one.
+type recoveryIdentity struct {
+	version   int
+	stateRoot common.Hash
+	blockHash common.Hash
+	// watched holds the watched addresses, sorted
+	watched []common.Address
+	// workers is the number of workers the ranges were divided among
+	workers uint
+	output  string
+}
+
+// recoveryIdentity returns the identity of the snapshot of header with params.
+func (s *Service) recoveryIdentity(header *types.Header, params SnapshotParams) recoveryIdentity {
+	watched := append([]common.Address(nil), params.WatchedAddresses...)
+	sort.Slice(watched, func(i, j int) bool { return watched[i].Cmp(watched[j]) < 0 })
+	return recoveryIdentity{
+		version:   recoveryVersion,
+		stateRoot: header.Root,
+		blockHash: header.Hash(),
+		watched:   watched,
+		workers:   max(params.Workers, 1),
+		output:    s.outputLocation,
+	}
+}
+
+// rows returns the identity rows written at the start of the recovery file.
+func (id recoveryIdentity) rows() [][]string {
+	watched := []string{recoveryWatchedKey}
+	for _, addr := range id.watched {
+		watched = append(watched, addr.Hex())
+	}
+	return [][]string{
+		{recoveryVersionKey, strconv.Itoa(id.version)},
+		{recoveryRootKey, id.stateRoot.Hex()},
+		{recoveryHashKey, id.blockHash.Hex()},
+		watched,
+		{recoveryWorkersKey, strconv.FormatUint(uint64(id.workers), 10)},
+		{recoveryOutputKey, id.output},
+	}
+}
+
+// parseRecoveryIdentity reads the identity rows from the rows of a recovery file, returning the
+// position rows which follow them. A file without identity rows is version 1.
+func parseRecoveryIdentity(rows [][]string) (recoveryIdentity, [][]string, error) {
+	id := recoveryIdentity{version: 1}
+	for len(rows) != 0 && strings.HasPrefix(rows[0][0], "#") {
+		row := rows[0]
+		rows = rows[1:]
+		if row[0] == recoveryWatchedKey {
+			for _, addr := range row[1:] {
+				id.watched = append(id.watched, common.HexToAddress(addr))
+			}
+			continue
+		}
+		if len(row) != 2 {
+			return id, nil, fmt.Errorf("identity row %s has %d fields", row[0], len(row))
+		}
+		var err error
+		switch row[0] {
+		case recoveryVersionKey:
+			id.version, err = strconv.Atoi(row[1])
+		case recoveryRootKey:
+			id.stateRoot = common.HexToHash(row[1])
+		case recoveryHashKey:
+			id.blockHash = common.HexToHash(row[1])
+		case recoveryWorkersKey:
+			var workers uint64
+			workers, err = strconv.ParseUint(row[1], 10, 0)
+			id.workers = uint(workers)
+		case recoveryOutputKey:
+			id.output = row[1]
+		default:
+			// keys added by later versions are caught by the version check
+		}
+		if err != nil {
+			return id, nil, fmt.Errorf("invalid identity row %s: %w", row[0], err)
+		}
+	}
+	if id.version > recoveryVersion {
+		return id, nil, fmt.Errorf("unsupported version %d", id.version)
+	}
+	return id, rows, nil
+}
+
+// mismatches describes how the identity saved in a recovery file differs from id. The number of
+// workers may differ, since the saved ranges are repartitioned on resume.
+func (id recoveryIdentity) mismatches(saved recoveryIdentity) []string {
+	if saved.version < 2 {
+		return []string{fmt.Sprintf("version %d file records no snapshot identity", saved.version)}
+	}
+	var diffs []string
+	if saved.stateRoot != id.stateRoot {
+		diffs = append(diffs, fmt.Sprintf("state root %s, not %s", saved.stateRoot, id.stateRoot))
+	}
+	if saved.blockHash != id.blockHash {
+		diffs = append(diffs, fmt.Sprintf("block hash %s, not %s", saved.blockHash, id.blockHash))
+	}
+	if !equalAddresses(saved.watched, id.watched) {
+		diffs = append(diffs, fmt.Sprintf("watched addresses %v, not %v", saved.watched, id.watched))
+	}
+	if saved.output != id.output {
+		diffs = append(diffs, fmt.Sprintf("output %q, not %q", saved.output, id.output))
+	}
+	return diffs
+}
+
+func equalAddresses(a, b []common.Address) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// savedRange is the remaining range of an iterator read from the recovery file. The leaf key and
+// CID of the account are set for a range of a storage trie.
+type savedRange struct {
+	path, endPath []byte
+	// start is the start of the range when it was first tracked, if hasStart is set
+	start    []byte
+	hasStart bool
+	leafKey  []byte
+	cid      string
+}
+
+// parseRanges parses the position rows of a recovery file of the given version. From version 3,
+// state rows hold the position, end and start of a range, and storage rows add the account's leaf
+// key and CID. Before then, rows have no start.
+func parseRanges(version int, rows [][]string) ([]savedRange, error) {
+	fields, hasStart := 2, version >= 3
+	if hasStart {
+		fields = 3
+	}
+	var ranges []savedRange
+	for _, row := range rows {
+		if len(row) != fields && len(row) != fields+2 {
+			return nil, fmt.Errorf("row has %d fields", len(row))
+		}
+		r := savedRange{hasStart: hasStart}
+		paths := []*[]byte{&r.path, &r.endPath}
+		if hasStart {
+			paths = append(paths, &r.start)
+		}
+		for i, path := range paths {
+			if len(row[i]) == 0 {
+				continue
+			}
+			if _, err := fmt.Sscanf(row[i], "%x", path); err != nil {
+				return nil, fmt.Errorf("invalid path %q: %w", row[i], err)
+			}
+		}
+		if len(row) == fields+2 {
+			if _, err := fmt.Sscanf(row[fields], "%x", &r.leafKey); err != nil {
+				return nil, fmt.Errorf("invalid leaf key %q: %w", row[fields], err)
+			}
+			r.cid = row[fields+1]
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+// checkRecovery checks that the recovery checkpoint, if there is one, was saved for the snapshot
+// with the given identity, and applies the mismatch policy if not. A mismatched checkpoint is
+// removed if the snapshot is to be restarted.
+func (s *Service) checkRecovery(ctx context.Context, recoveryFile string, id recoveryIdentity) error {
+	rows, err := s.recovery.Load(ctx, recoveryFile)
+	if err != nil {
+		return fmt.Errorf("failed to load recovery checkpoint %s: %w", recoveryFile, err)
+	}
+	if rows == nil {
+		return nil
+	}
+	saved, _, err := parseRecoveryIdentity(rows)
+	if err != nil {
+		return fmt.Errorf("invalid recovery file %s: %w", recoveryFile, err)
+	}
+	diffs := id.mismatches(saved)
+	if len(diffs) == 0 {
+		return nil
+	}
+	logger := log.WithField("file", recoveryFile).WithField("mismatch", strings.Join(diffs, "; "))
+	switch s.recoveryMismatch {
+	case RestartOnMismatch:
+		logger.Warn("Recovery file does not match snapshot, starting over")
+		if err = s.recovery.Remove(ctx, recoveryFile); err != nil {
+			return fmt.Errorf("failed to remove mismatched recovery file: %w", err)
+		}
+		return nil
+	case ResumeOnMismatch:
+		logger.Warn("Recovery file does not match snapshot, resuming anyway")
+		return nil
+	}
+	return fmt.Errorf("%w: %s was saved with %s", ErrRecoveryMismatch, recoveryFile, strings.Join(diffs, "; "))
+}
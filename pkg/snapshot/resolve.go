@@ -0,0 +1,172 @@
+// Copyright © 2024 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethdb"
+	log "github.com/sirupsen/logrus"
+)
+
+// BlockTag names a block by its position relative to the chain head.
+type BlockTag string
+
+const (
+	LatestBlock    BlockTag = "latest"
+	FinalizedBlock BlockTag = "finalized"
+	SafeBlock      BlockTag = "safe"
+)
+
+// HeaderByHash reads the header with the given hash. The block need not be canonical, so headers of
+// reorged blocks which are still present in the database can be read.
+func HeaderByHash(db ethdb.Reader, hash common.Hash) (*types.Header, error) {
+	number := rawdb.ReadHeaderNumber(db, hash)
+	if number == nil {
+		return nil, fmt.Errorf("unable to read header height for header hash %s", hash)
+	}
+	header := rawdb.ReadHeader(db, hash, *number)
+	if header == nil {
+		return nil, fmt.Errorf("unable to read header %s at height %d", hash, *number)
+	}
+	if rawdb.ReadCanonicalHash(db, *number) != hash {
+		log.WithField("height", *number).WithField("hash", hash).Warn("Header is not canonical")
+	}
+	return header, nil
+}
+
+// HeaderAtTime finds the last canonical header with a timestamp at or before the given Unix time.
+func HeaderAtTime(db ethdb.Reader, timestamp uint64) (*types.Header, error) {
+	head, err := HeaderByTag(db, LatestBlock)
+	if err != nil {
+		return nil, err
+	}
+	// timestamps increase monotonically, so search for the first header after the target time
+	var searchErr error
+	count := sort.Search(int(head.Number.Uint64())+1, func(i int) bool {
+		hash := rawdb.ReadCanonicalHash(db, uint64(i))
+		header := rawdb.ReadHeader(db, hash, uint64(i))
+		if header == nil {
+			searchErr = fmt.Errorf("unable to read canonical header at height %d", i)
+			return true
+		}
+		return header.Time > timestamp
+	})
+	if searchErr != nil {
+		return nil, searchErr
+	}
+	if count == 0 {
+		return nil, fmt.Errorf("no block found at or before time %d", timestamp)
+	}
+	height := uint64(count - 1)
+	header := rawdb.ReadHeader(db, rawdb.ReadCanonicalHash(db, height), height)
+	if header == nil {
+		return nil, fmt.Errorf("unable to read canonical header at height %d", height)
+	}
+	return header, nil
+}
+
+// HeaderByTag reads the header marked by the given tag.
+//
+// Geth does not persist the safe block; on startup it restores it to the last finalized block, so
+// the same is done here.
+func HeaderByTag(db ethdb.Reader, tag BlockTag) (*types.Header, error) {
+	var hash common.Hash
+	switch tag {
+	case LatestBlock:
+		hash = rawdb.ReadHeadHeaderHash(db)
+	case FinalizedBlock, SafeBlock:
+		hash = rawdb.ReadFinalizedBlockHash(db)
+		if hash == (common.Hash{}) {
+			return nil, fmt.Errorf("no finalized block recorded in ethdb")
+		}
+	default:
+		return nil, fmt.Errorf("unknown block tag %q", tag)
+	}
+	return HeaderByHash(db, hash)
+}
+
+// LatestHeaderWithState finds the newest block on the canonical chain whose state root node is
+// present in the ethdb. On a hash-scheme database, the state at the head is usually only held in
+// memory by geth and is lost unless it shuts down cleanly.
+func LatestHeaderWithState(db ethdb.Reader) (*types.Header, error) {
+	head, err := HeaderByTag(db, LatestBlock)
+	if err != nil {
+		return nil, err
+	}
+	header := head
+	for !hasStateRoot(db, header.Root) {
+		if header.Number.Sign() == 0 {
+			return nil, fmt.Errorf("no state found for any block at or below head %d", head.Number)
+		}
+		height := header.Number.Uint64() - 1
+		if header = rawdb.ReadHeader(db, header.ParentHash, height); header == nil {
+			return nil, fmt.Errorf("unable to read header at height %d", height)
+		}
+	}
+	if behind := head.Number.Uint64() - header.Number.Uint64(); behind > 0 {
+		log.WithField("height", header.Number).WithField("head", head.Number).
+			Infof("State at head is unavailable, latest available state is %d blocks behind", behind)
+	}
+	return header, nil
+}
+
+func hasStateRoot(db ethdb.KeyValueReader, root common.Hash) bool {
+	return root == types.EmptyRootHash || rawdb.HasLegacyTrieNode(db, root)
+}
+
+// syntheticExtra marks the extra data of headers which were made up to hold a state root.
+var syntheticExtra = []byte("eth-state-snapshot:synthetic")
+
+// SyntheticHeader creates a placeholder header at the given height for a state root for which no
+// real header is available. It is flagged as synthetic in its extra data.
+func SyntheticHeader(root common.Hash, height uint64) *types.Header {
+	return &types.Header{
+		Root:        root,
+		Number:      new(big.Int).SetUint64(height),
+		Difficulty:  new(big.Int),
+		UncleHash:   types.EmptyUncleHash,
+		TxHash:      types.EmptyTxsHash,
+		ReceiptHash: types.EmptyReceiptsHash,
+		Extra:       syntheticExtra,
+	}
+}
+
+// IsSyntheticHeader reports whether the header was created by SyntheticHeader.
+func IsSyntheticHeader(header *types.Header) bool {
+	return bytes.Equal(header.Extra, syntheticExtra)
+}
+
+// ReadHeaderJSON reads a header in the JSON format returned by eth_getBlockByNumber.
+func ReadHeaderJSON(path string) (*types.Header, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	header := new(types.Header)
+	if err := json.Unmarshal(data, header); err != nil {
+		return nil, fmt.Errorf("failed to decode header from %s: %w", path, err)
+	}
+	return header, nil
+}
@@ -0,0 +1,194 @@
+package snapshot_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cerc-io/eth-testing/chains"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cerc-io/ipld-eth-state-snapshot/internal/mocks"
+	. "github.com/cerc-io/ipld-eth-state-snapshot/pkg/snapshot"
+	fixture "github.com/cerc-io/ipld-eth-state-snapshot/test"
+)
+
+func openEthDB(t *testing.T, chain *chains.Paths) ethdb.Database {
+	config := testConfig(chain.ChainData, chain.Ancient)
+	edb, err := NewEthDB(config.Eth)
+	require.NoError(t, err)
+	t.Cleanup(func() { edb.Close() })
+	return edb
+}
+
+func TestHeaderByHash(t *testing.T) {
+	edb := openEthDB(t, fixture.ChainA)
+
+	expected := rawdb.ReadHeader(edb, rawdb.ReadCanonicalHash(edb, 5), 5)
+	header, err := HeaderByHash(edb, expected.Hash())
+	require.NoError(t, err)
+	require.Equal(t, expected.Hash(), header.Hash())
+
+	_, err = HeaderByHash(edb, common.HexToHash("0xdeadbeef"))
+	require.Error(t, err)
+}
+
+func TestHeaderAtTime(t *testing.T) {
+	edb := openEthDB(t, fixture.ChainA)
+	head, err := HeaderByTag(edb, LatestBlock)
+	require.NoError(t, err)
+
+	for _, height := range []uint64{0, 1, 10, head.Number.Uint64()} {
+		expected := rawdb.ReadHeader(edb, rawdb.ReadCanonicalHash(edb, height), height)
+		t.Run(fmt.Sprintf("at height %d", height), func(t *testing.T) {
+			header, err := HeaderAtTime(edb, expected.Time)
+			require.NoError(t, err)
+			require.Equal(t, height, header.Number.Uint64())
+		})
+	}
+
+	// a time between blocks resolves to the earlier block
+	next := rawdb.ReadHeader(edb, rawdb.ReadCanonicalHash(edb, 11), 11)
+	header, err := HeaderAtTime(edb, next.Time-1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), header.Number.Uint64())
+
+	genesis := rawdb.ReadHeader(edb, rawdb.ReadCanonicalHash(edb, 0), 0)
+	if genesis.Time > 0 {
+		_, err = HeaderAtTime(edb, genesis.Time-1)
+		require.Error(t, err)
+	}
+}
+
+func TestHeaderByTag(t *testing.T) {
+	edb := openEthDB(t, fixture.ChainA)
+
+	head, err := HeaderByTag(edb, LatestBlock)
+	require.NoError(t, err)
+	require.Equal(t, rawdb.ReadHeadHeaderHash(edb), head.Hash())
+
+	finalized, err := HeaderByTag(edb, FinalizedBlock)
+	require.NoError(t, err)
+	require.Equal(t, rawdb.ReadFinalizedBlockHash(edb), finalized.Hash())
+
+	safe, err := HeaderByTag(edb, SafeBlock)
+	require.NoError(t, err)
+	require.Equal(t, finalized.Hash(), safe.Hash())
+
+	_, err = HeaderByTag(edb, "pending")
+	require.Error(t, err)
+
+	// chain B has no finalized block
+	_, err = HeaderByTag(openEthDB(t, fixture.ChainB), FinalizedBlock)
+	require.Error(t, err)
+}
+
+func TestSnapshotByHash(t *testing.T) {
+	config := testConfig(fixture.ChainA.ChainData, fixture.ChainA.Ancient)
+	edb, err := NewEthDB(config.Eth)
+	require.NoError(t, err)
+	hash := rawdb.ReadCanonicalHash(edb, 1)
+	edb.Close()
+
+	data := doSnapshot(t, fixture.ChainA, SnapshotParams{BlockHash: hash, Workers: 4})
+	verify_chainAblock1(t, data)
+}
+
+func TestSnapshotStateRoot(t *testing.T) {
+	config := testConfig(fixture.ChainA.ChainData, fixture.ChainA.Ancient)
+	edb, err := NewEthDB(config.Eth)
+	require.NoError(t, err)
+	block1 := rawdb.ReadHeader(edb, rawdb.ReadCanonicalHash(edb, 1), 1)
+	edb.Close()
+
+	t.Run("with synthetic header", func(t *testing.T) {
+		data := doSnapshot(t, fixture.ChainA, SnapshotParams{StateRoot: block1.Root, Height: 7, Workers: 4})
+		verify_chainAblock1(t, data)
+		require.Len(t, data.Headers, 1)
+		require.Contains(t, data.Headers, uint64(7))
+		require.True(t, IsSyntheticHeader(data.Headers[7]))
+		require.Equal(t, block1.Root, data.Headers[7].Root)
+	})
+
+	t.Run("with header from JSON", func(t *testing.T) {
+		enc, err := json.Marshal(block1)
+		require.NoError(t, err)
+		path := filepath.Join(t.TempDir(), "header.json")
+		require.NoError(t, os.WriteFile(path, enc, 0644))
+		header, err := ReadHeaderJSON(path)
+		require.NoError(t, err)
+
+		data := doSnapshot(t, fixture.ChainA, SnapshotParams{StateRoot: block1.Root, Header: header, Workers: 4})
+		verify_chainAblock1(t, data)
+		require.Equal(t, block1.Hash(), data.Headers[1].Hash())
+		require.False(t, IsSyntheticHeader(data.Headers[1]))
+	})
+
+	t.Run("with mismatched header", func(t *testing.T) {
+		err := trySnapshot(t, fixture.ChainA, SnapshotParams{StateRoot: common.HexToHash("0x01"), Header: block1})
+		require.Error(t, err)
+	})
+
+	t.Run("with missing root", func(t *testing.T) {
+		err := trySnapshot(t, fixture.ChainA, SnapshotParams{StateRoot: common.HexToHash("0x01")})
+		require.Error(t, err)
+	})
+}
+
+func trySnapshot(t *testing.T, chain *chains.Paths, params SnapshotParams) error {
+	service, err := NewSnapshotService(openEthDB(t, chain), mocks.NewIndexer(t), "")
+	require.NoError(t, err)
+	_, err = service.CreateSnapshot(context.Background(), params)
+	return err
+}
+
+func TestLatestHeaderWithState(t *testing.T) {
+	edb := openEthDB(t, fixture.ChainA)
+	head, err := HeaderByTag(edb, LatestBlock)
+	require.NoError(t, err)
+
+	header, err := LatestHeaderWithState(edb)
+	require.NoError(t, err)
+	require.Equal(t, head.Hash(), header.Hash())
+
+	// drop the two most recent state roots, as if geth had not flushed them
+	memdb := rawdb.NewMemoryDatabase()
+	it := edb.NewIterator(nil, nil)
+	for it.Next() {
+		require.NoError(t, memdb.Put(it.Key(), it.Value()))
+	}
+	it.Release()
+	missing := map[common.Hash]struct{}{}
+	expected := head
+	for len(missing) < 2 {
+		missing[expected.Root] = struct{}{}
+		rawdb.DeleteLegacyTrieNode(memdb, expected.Root)
+		for {
+			number := expected.Number.Uint64() - 1
+			expected = rawdb.ReadHeader(memdb, expected.ParentHash, number)
+			if _, has := missing[expected.Root]; !has {
+				break
+			}
+		}
+	}
+
+	header, err = LatestHeaderWithState(memdb)
+	require.NoError(t, err)
+	require.Equal(t, expected.Hash(), header.Hash())
+	require.Less(t, header.Number.Uint64(), head.Number.Uint64())
+
+	idx := mocks.NewIndexer(t)
+	service, err := NewSnapshotService(memdb, idx, filepath.Join(t.TempDir(), "recover.csv"))
+	require.NoError(t, err)
+	result, err := service.CreateLatestSnapshot(context.Background(), 4, nil)
+	require.NoError(t, err)
+	require.Equal(t, expected.Hash(), result.BlockHash)
+	require.Len(t, idx.Headers, 1)
+	require.Equal(t, expected.Hash(), idx.Headers[expected.Number.Uint64()].Hash())
+}
@@ -0,0 +1,83 @@
+// Copyright © 2024 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// SnapshotResult describes a snapshot written by CreateSnapshot.
+type SnapshotResult struct {
+	Height    uint64      `json:"height"`
+	BlockHash common.Hash `json:"blockHash"`
+	StateRoot common.Hash `json:"stateRoot"`
+	// HeaderID is the ID the header was written with, which is empty if the snapshot was not
+	// written because it already existed.
+	HeaderID string `json:"headerID,omitempty"`
+	// Existing is what was done about a snapshot already in the output.
+	Existing ExistingAction `json:"existing,omitempty"`
+
+	// The counts only cover this run, so exclude what was written before a resumed snapshot was
+	// interrupted.
+	StateNodes   uint64 `json:"stateNodes"`
+	StorageNodes uint64 `json:"storageNodes"`
+	IPLDs        uint64 `json:"iplds"`
+	CodeNodes    uint64 `json:"codeNodes"`
+	// Bytes is the size of the IPLD block data written.
+	Bytes uint64 `json:"bytes"`
+
+	Duration time.Duration `json:"-"`
+	Workers  uint          `json:"workers"`
+	// Output is where the snapshot was written, as set by SetOutputLocation.
+	Output string `json:"output,omitempty"`
+}
+
+// SetOutputLocation sets a description of where the output is written, such as a directory or
+// database, to be recorded in each SnapshotResult.
+func (s *Service) SetOutputLocation(location string) {
+	s.outputLocation = location
+}
+
+func (s *Service) newResult(header *types.Header, workers uint) *SnapshotResult {
+	return &SnapshotResult{
+		Height:    header.Number.Uint64(),
+		BlockHash: header.Hash(),
+		StateRoot: header.Root,
+		Workers:   workers,
+		Output:    s.outputLocation,
+	}
+}
+
+func (r *SnapshotResult) setCounts(counts *nodeCounts) {
+	r.StateNodes = counts.state.Load()
+	r.StorageNodes = counts.storage.Load()
+	r.IPLDs = counts.iplds.Load()
+	r.CodeNodes = counts.codes.Load()
+	r.Bytes = counts.bytes.Load()
+}
+
+// MarshalJSON encodes the result with its duration in seconds.
+func (r SnapshotResult) MarshalJSON() ([]byte, error) {
+	type result SnapshotResult
+	return json.Marshal(struct {
+		result
+		Duration float64 `json:"durationSeconds"`
+	}{result(r), r.Duration.Seconds()})
+}
@@ -0,0 +1,52 @@
+package snapshot_test
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cerc-io/ipld-eth-state-snapshot/internal/mocks"
+	. "github.com/cerc-io/ipld-eth-state-snapshot/pkg/snapshot"
+	fixture "github.com/cerc-io/ipld-eth-state-snapshot/test"
+)
+
+func TestSnapshotResult(t *testing.T) {
+	edb := openEthDB(t, fixture.ChainA)
+	idx := mocks.NewIndexer(t)
+	service, err := NewSnapshotService(edb, idx, filepath.Join(t.TempDir(), "recover.csv"))
+	require.NoError(t, err)
+	service.SetOutputLocation("output")
+
+	heights := []uint64{1, 3}
+	results, err := service.CreateSnapshot(context.Background(), SnapshotParams{Heights: heights, Workers: 4})
+	require.NoError(t, err)
+	require.Len(t, results, len(heights))
+	var iplds uint64
+	for i, result := range results {
+		header := rawdb.ReadHeader(edb, rawdb.ReadCanonicalHash(edb, heights[i]), heights[i])
+		require.Equal(t, heights[i], result.Height)
+		require.Equal(t, header.Hash(), result.BlockHash)
+		require.Equal(t, header.Root, result.StateRoot)
+		require.Equal(t, header.Hash().String(), result.HeaderID)
+		require.Equal(t, NoExisting, result.Existing)
+		require.Equal(t, uint(4), result.Workers)
+		require.Equal(t, "output", result.Output)
+		require.NotZero(t, result.Bytes)
+		require.NotZero(t, result.Duration)
+		iplds += result.IPLDs
+	}
+	require.Equal(t, uint64(len(fixture.ChainA_Block1_StateNodeLeafKeys)), results[0].StateNodes)
+	require.Equal(t, uint64(len(idx.IPLDs)), iplds)
+
+	encoded, err := json.Marshal(results[0])
+	require.NoError(t, err)
+	var decoded map[string]any
+	require.NoError(t, json.Unmarshal(encoded, &decoded))
+	require.Equal(t, float64(1), decoded["height"])
+	require.Equal(t, results[0].BlockHash.Hex(), decoded["blockHash"])
+	require.Equal(t, results[0].Duration.Seconds(), decoded["durationSeconds"])
+}
@@ -17,21 +17,16 @@ package snapshot
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"math/big"
-	"os"
-	"os/signal"
-	"sync"
-	"syscall"
-
-	"github.com/cerc-io/ipld-eth-state-snapshot/pkg/prom"
-	statediff "github.com/cerc-io/plugeth-statediff"
-	"github.com/cerc-io/plugeth-statediff/adapt"
+	"time"
+
 	"github.com/cerc-io/plugeth-statediff/indexer"
-	"github.com/cerc-io/plugeth-statediff/types"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/rawdb"
 	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/rlp"
@@ -43,17 +38,42 @@ var (
 	emptyCodeHash     = crypto.Keccak256([]byte{})
 	emptyContractRoot = crypto.Keccak256Hash(emptyNode)
 
-	defaultBatchSize = uint(100)
+	defaultBatchSize  = uint(100)
+	defaultBatchBytes = uint(0)
+	// records queued for each writer
+	defaultQueueLength = uint(1024)
+	// CIDs remembered to deduplicate IPLDs between the heights of a run
+	defaultDedupSize = uint(1_000_000)
+
+	defaultCheckpointInterval = time.Minute
 )
 
 // Service holds ethDB and stateDB to read data from lvldb and Publisher
 // to publish trie in postgres DB.
 type Service struct {
-	ethDB        ethdb.Database
-	stateDB      state.Database
-	indexer      indexer.Indexer
-	maxBatchSize uint
-	recoveryFile string
+	ethDB          ethdb.Database
+	stateDB        state.Database
+	indexer        indexer.Indexer
+	maxBatchSize   uint
+	maxBatchBytes  uint
+	writers        uint
+	queueLength    uint
+	dedupSize      uint
+	storageSplit   uint64
+	commitInterval uint
+	recoveryFile   string
+	verifier       IPLDSource
+	catalog        Catalog
+	existingPolicy ExistingPolicy
+	output         Output
+
+	checkpointInterval time.Duration
+	recoveryMismatch   RecoveryMismatchPolicy
+	recovery           RecoveryStore
+
+	progress         ProgressObserver
+	progressInterval time.Duration
+	outputLocation   string
 }
 
 func NewEthDB(con *EthDBConfig) (ethdb.Database, error) {
@@ -70,103 +90,269 @@ func NewEthDB(con *EthDBConfig) (ethdb.Database, error) {
 // NewSnapshotService creates Service.
 func NewSnapshotService(edb ethdb.Database, indexer indexer.Indexer, recoveryFile string) (*Service, error) {
 	return &Service{
-		ethDB:        edb,
-		stateDB:      state.NewDatabase(edb),
-		indexer:      indexer,
-		maxBatchSize: defaultBatchSize,
-		recoveryFile: recoveryFile,
+		ethDB:         edb,
+		stateDB:       state.NewDatabase(edb),
+		indexer:       indexer,
+		maxBatchSize:  defaultBatchSize,
+		maxBatchBytes: defaultBatchBytes,
+		queueLength:   defaultQueueLength,
+		dedupSize:     defaultDedupSize,
+		storageSplit:  defaultStorageSplit,
+		recoveryFile:  recoveryFile,
+
+		checkpointInterval: defaultCheckpointInterval,
+		recoveryMismatch:   FailOnMismatch,
+		recovery:           NewFileRecoveryStore(),
 	}, nil
 }
 
+// SetCommitInterval sets the number of nodes after which the snapshot transaction is committed and
+// a recovery checkpoint is saved. Transactions are also committed whenever a subtrie is completed,
+// and at the checkpoint interval.
+func (s *Service) SetCommitInterval(n uint) {
+	s.commitInterval = n
+}
+
+// SetDedupSize sets the number of CIDs remembered to skip IPLDs already written at another height of
+// the same run. Once it is reached the oldest are forgotten, and IPLDs written again are left to the
+// indexer to ignore. If cids is 0, IPLDs are not deduplicated between heights.
+func (s *Service) SetDedupSize(cids uint) {
+	s.dedupSize = cids
+}
+
+// SetCheckpointInterval sets the time after which the snapshot transaction is committed and a
+// recovery checkpoint is saved, if anything has been written since the last one. If d is 0,
+// checkpoints are only saved by node count and when subtries are completed.
+func (s *Service) SetCheckpointInterval(d time.Duration) {
+	s.checkpointInterval = d
+}
+
 type SnapshotParams struct {
 	WatchedAddresses []common.Address
-	Height           uint64
-	Workers          uint
+	// Height is the block height to snapshot. Ignored if Heights or BlockHash is set.
+	Height uint64
+	// Heights lists multiple block heights to snapshot in a single run. Each height gets its own
+	// header and state/storage records, but IPLD blocks are only emitted for the first height at
+	// which they appear.
+	Heights []uint64
+	// BlockHash selects the block to snapshot by hash, which need not be canonical.
+	BlockHash common.Hash
+	// StateRoot selects a state root to snapshot directly, for which there may be no header in the
+	// ethdb. The output is written against Header if it is set, or else a synthetic header at Height.
+	StateRoot common.Hash
+	// Header, if set, is written in place of a header read from the ethdb, and its state root is
+	// snapshotted.
+	Header  *types.Header
+	Workers uint
 }
 
-func (s *Service) CreateSnapshot(params SnapshotParams) error {
-	// extract header from lvldb and publish to PG-IPFS
-	// hold onto the headerID so that we can link the state nodes to this header
-	hash := rawdb.ReadCanonicalHash(s.ethDB, params.Height)
-	header := rawdb.ReadHeader(s.ethDB, hash, params.Height)
+// CreateSnapshot publishes the headers selected by params and the full state at each of them, and
+// returns a result for each snapshot. If ctx is cancelled or its deadline passes, the workers stop
+// after their current node, what has been written is committed and their positions are saved to
+// the recovery file, and the context's error is returned along with the results of the snapshots
+// already completed.
+func (s *Service) CreateSnapshot(ctx context.Context, params SnapshotParams) ([]*SnapshotResult, error) {
+	if s.verifier != nil && len(params.WatchedAddresses) != 0 {
+		return nil, fmt.Errorf("snapshots of watched addresses cannot be verified")
+	}
+	// extract headers from lvldb up front, so we fail before doing any work
+	headers, err := s.ResolveHeaders(params)
+	if err != nil {
+		return nil, err
+	}
+
+	// IPLDs are shared between heights, so avoid pushing them again where possible
+	var seen []*boundedCIDSet
+	if len(headers) > 1 && s.dedupSize > 0 {
+		writers := s.writerCount(params.Workers)
+		for i := 0; i < writers; i++ {
+			seen = append(seen, newBoundedCIDSet(max(int(s.dedupSize)/writers, 1)))
+		}
+	}
+	var results []*SnapshotResult
+	for _, header := range headers {
+		if err = ctx.Err(); err != nil {
+			return results, err
+		}
+		start := time.Now()
+		result := s.newResult(header, params.Workers)
+		recoveryFile := s.recoveryFile
+		if len(headers) > 1 {
+			recoveryFile = fmt.Sprintf("%s_%d", s.recoveryFile, header.Number)
+		}
+		if err = s.checkRecovery(ctx, recoveryFile, s.recoveryIdentity(header, params)); err != nil {
+			return results, err
+		}
+		result.Existing, err = s.preflight(ctx, header, recoveryFile)
+		if err != nil {
+			return results, err
+		}
+		if result.Existing != SkippedExisting && result.Existing != VerifiedExisting {
+			err = s.writeSnapshot(ctx, header, params, recoveryFile, seen, result)
+			if err = s.recordOutcome(ctx, header, err); err != nil {
+				return results, err
+			}
+		}
+		result.Duration = time.Since(start)
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// ResolveHeaders reads the headers selected by params from the ethdb.
+func (s *Service) ResolveHeaders(params SnapshotParams) ([]*types.Header, error) {
+	var headers []*types.Header
+	if params.StateRoot != (common.Hash{}) || params.Header != nil {
+		header, err := s.rootHeader(params)
+		if err != nil {
+			return nil, err
+		}
+		headers = append(headers, header)
+	} else if params.BlockHash != (common.Hash{}) {
+		header, err := HeaderByHash(s.ethDB, params.BlockHash)
+		if err != nil {
+			return nil, err
+		}
+		headers = append(headers, header)
+	} else {
+		heights := params.Heights
+		if len(heights) == 0 {
+			heights = []uint64{params.Height}
+		}
+		for _, height := range heights {
+			header, err := s.canonicalHeader(height)
+			if err != nil {
+				return nil, err
+			}
+			headers = append(headers, header)
+		}
+	}
+	return headers, nil
+}
+
+// rootHeader returns the header to write when snapshotting a raw state root, after checking that the
+// root is present in the ethdb.
+func (s *Service) rootHeader(params SnapshotParams) (*types.Header, error) {
+	header := params.Header
 	if header == nil {
-		return fmt.Errorf("unable to read canonical header at height %d", params.Height)
+		header = SyntheticHeader(params.StateRoot, params.Height)
+		log.WithField("root", params.StateRoot).Warn("Using synthetic header for state root")
+	} else if params.StateRoot != (common.Hash{}) && params.StateRoot != header.Root {
+		return nil, fmt.Errorf("state root %s does not match header root %s", params.StateRoot, header.Root)
 	}
-	log.WithField("height", params.Height).WithField("hash", hash).Info("Creating snapshot")
+	if _, err := s.stateDB.OpenTrie(header.Root); err != nil {
+		return nil, fmt.Errorf("state root %s not found in ethdb: %w", header.Root, err)
+	}
+	return header, nil
+}
 
-	// Context for snapshot work
-	ctx, cancelCtx := context.WithCancel(context.Background())
-	defer cancelCtx()
-	// Cancel context on receiving a signal. On cancellation, all tracked iterators complete
-	// processing of their current node before stopping.
-	captureSignal(cancelCtx)
+// writeSnapshot publishes the header and the full state at that header, and records what was
+// written in result. If seen is non-nil, IPLDs already present in the set of the writer they are
+// queued to are skipped.
+func (s *Service) writeSnapshot(
+	ctx context.Context, header *types.Header, params SnapshotParams, recoveryFile string, seen []*boundedCIDSet,
+	result *SnapshotResult,
+) (err error) {
+	log.WithField("height", header.Number).WithField("hash", header.Hash()).Info("Creating snapshot")
 
-	var err error
-	tx := s.indexer.BeginTx(header.Number, ctx)
-	defer tx.RollbackOnFailure(err)
+	// Stop all workers as soon as anything fails
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// checkpoints are saved after the run is cancelled, along with what was written before it
+	tr := newIteratorTracker(context.WithoutCancel(ctx), s.recovery, recoveryFile, s.recoveryIdentity(header, params))
+	// Writes are not cancelled with the workers, so that an interrupted snapshot can be committed
+	txs := newChunkedTxs(context.WithoutCancel(ctx), s.indexer, header.Number, s.writerCount(params.Workers), cancel)
+	counts := new(nodeCounts)
+	defer result.setCounts(counts)
+	if s.progress != nil {
+		progress := newSnapshotProgress(s.progress, header, tr, counts)
+		stop := progress.run(s.progressInterval)
+		defer func() {
+			stop()
+			progress.finish(err)
+		}()
+	}
+	defer func() { rollbackOnFailure(txs, err) }()
 
-	var headerid string
-	headerid, err = s.indexer.PushHeader(tx, header, big.NewInt(0), big.NewInt(0))
+	// hold onto the headerID so that we can link the state nodes to this header
+	headerid, err := s.pushHeader(txs[0], header)
 	if err != nil {
 		return err
 	}
+	result.HeaderID = headerid
 
-	tr := prom.NewTracker(s.recoveryFile, params.Workers)
-	defer func() {
-		err := tr.CloseAndSave()
-		if err != nil {
-			log.Errorf("failed to write recovery file: %v", err)
-		}
-	}()
+	writers := s.newPipeline(txs, tr, headerid, seen, counts, cancel)
+	nodeSink, ipldSink := writers.sinks()
 
-	var nodeMtx, ipldMtx sync.Mutex
-	nodeSink := func(node types.StateLeafNode) error {
-		nodeMtx.Lock()
-		defer nodeMtx.Unlock()
-		prom.IncStateNodeCount()
-		prom.AddStorageNodeCount(len(node.StorageDiff))
-		return s.indexer.PushStateNode(tx, node, headerid)
+	err = s.walkState(runCtx, header.Root, params.WatchedAddresses, params.Workers, tr,
+		nodeSink, ipldSink, writers.storageSink())
+	// If interrupted, every node before the iterators' positions has been emitted, so keep what
+	// has been emitted so far.
+	interrupted := err != nil && ctx.Err() != nil
+	// The walker only returns the first error from its workers, which may just be the result of
+	// a failure to write or commit.
+	if txErr := writers.Close(err == nil || interrupted); txErr != nil && !errors.Is(err, txErr) {
+		if interrupted {
+			txErr = fmt.Errorf("failed to commit interrupted snapshot: %w", txErr)
+		}
+		err = errors.Join(err, txErr)
 	}
-	ipldSink := func(c types.IPLD) error {
-		ipldMtx.Lock()
-		defer ipldMtx.Unlock()
-		return s.indexer.PushIPLD(tx, c)
+	if err != nil {
+		return err
+	}
+
+	if s.verifier != nil {
+		if err = VerifyStateRoot(ctx, s.verifier, header.Root); err != nil {
+			return fmt.Errorf("verification of snapshot at height %d failed: %w", header.Number, err)
+		}
 	}
+	return nil
+}
+
+// pushHeader writes the header to tx, returning its ID.
+func (s *Service) pushHeader(tx *chunkedTx, header *types.Header) (headerid string, err error) {
+	err = tx.push(0, func(b indexer.Batch) (err error) {
+		headerid, err = s.indexer.PushHeader(b, header, big.NewInt(0), big.NewInt(0))
+		return err
+	})
+	return headerid, err
+}
 
-	sdparams := statediff.Params{
-		WatchedAddresses: params.WatchedAddresses,
+// recordOutcome records in the catalog whether the snapshot at header failed with err. The
+// returned error includes err and any failure to record it.
+func (s *Service) recordOutcome(ctx context.Context, header *types.Header, err error) error {
+	if s.catalog == nil {
+		return err
 	}
-	sdparams.ComputeWatchedAddressesLeafPaths()
-	builder := statediff.NewBuilder(adapt.GethStateView(s.stateDB))
-	builder.SetSubtrieWorkers(params.Workers)
-	if err = builder.WriteStateSnapshot(ctx, header.Root, sdparams, nodeSink, ipldSink, tr); err != nil {
+	// the run may have been cancelled, but the outcome should still be recorded
+	ctx = context.WithoutCancel(ctx)
+	if err != nil {
+		log.WithField("height", header.Number).WithField("hash", header.Hash()).
+			Warn("Marking snapshot as incomplete")
+		if cerr := s.catalog.MarkIncomplete(ctx, header, err); cerr != nil {
+			return errors.Join(err, fmt.Errorf("failed to mark snapshot as incomplete: %w", cerr))
+		}
 		return err
 	}
-
-	if err = tx.Submit(); err != nil {
-		return fmt.Errorf("batch transaction submission failed: %w", err)
+	if cerr := s.catalog.MarkComplete(ctx, header); cerr != nil {
+		return fmt.Errorf("failed to mark snapshot as complete: %w", cerr)
 	}
-	return err
+	return nil
 }
 
-// CreateLatestSnapshot snapshot at head (ignores height param)
-func (s *Service) CreateLatestSnapshot(workers uint, watchedAddresses []common.Address) error {
+// CreateLatestSnapshot snapshot at the latest block whose state is available (ignores height param)
+func (s *Service) CreateLatestSnapshot(
+	ctx context.Context, workers uint, watchedAddresses []common.Address,
+) (*SnapshotResult, error) {
 	log.Info("Creating snapshot at head")
-	hash := rawdb.ReadHeadHeaderHash(s.ethDB)
-	height := rawdb.ReadHeaderNumber(s.ethDB, hash)
-	if height == nil {
-		return fmt.Errorf("unable to read header height for header hash %s", hash)
+	header, err := LatestHeaderWithState(s.ethDB)
+	if err != nil {
+		return nil, err
 	}
-	return s.CreateSnapshot(SnapshotParams{Height: *height, Workers: workers, WatchedAddresses: watchedAddresses})
-}
-
-func captureSignal(cb func()) {
-	sigChan := make(chan os.Signal, 1)
-
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	go func() {
-		sig := <-sigChan
-		log.Errorf("Signal received (%v), stopping", sig)
-		cb()
-	}()
+	results, err := s.CreateSnapshot(ctx, SnapshotParams{BlockHash: header.Hash(), Workers: workers, WatchedAddresses: watchedAddresses})
+	if err != nil {
+		return nil, err
+	}
+	return results[0], nil
 }
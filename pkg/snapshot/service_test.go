@@ -1,16 +1,27 @@
 package snapshot_test
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"math/rand"
+	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/cerc-io/eth-testing/chains"
+	"github.com/cerc-io/plugeth-statediff/indexer"
+	"github.com/cerc-io/plugeth-statediff/indexer/ipld"
 	"github.com/cerc-io/plugeth-statediff/indexer/models"
+	sdtypes "github.com/cerc-io/plugeth-statediff/types"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/stretchr/testify/require"
 
 	"github.com/cerc-io/ipld-eth-state-snapshot/internal/mocks"
@@ -75,6 +86,224 @@ func TestAccountSelectiveSnapshot(t *testing.T) {
 	}
 }
 
+func TestSnapshotCode(t *testing.T) {
+	runCase := func(t *testing.T, workers uint) {
+		data := doSnapshot(t, fixture.ChainA, SnapshotParams{Height: 262, Workers: workers})
+
+		expected := make(map[string]struct{})
+		for _, node := range data.StateNodes {
+			codeHash := node.AccountWrapper.Account.CodeHash
+			if !bytes.Equal(codeHash, types.EmptyCodeHash.Bytes()) {
+				expected[ipld.Keccak256ToCid(ipld.RawBinary, codeHash).String()] = struct{}{}
+			}
+		}
+		require.NotEmpty(t, expected)
+
+		codes := make(map[string]struct{})
+		for _, block := range data.IPLDs {
+			if _, has := expected[block.CID]; has {
+				require.NotContains(t, codes, block.CID, "duplicate code IPLD")
+				require.Equal(t, block.CID, ipld.Keccak256ToCid(ipld.RawBinary, crypto.Keccak256(block.Content)).String())
+				codes[block.CID] = struct{}{}
+			}
+		}
+		require.Equal(t, expected, codes)
+	}
+
+	for _, tc := range subtrieWorkerCases {
+		t.Run(fmt.Sprintf("with %d subtries", tc), func(t *testing.T) { runCase(t, tc) })
+	}
+}
+
+func TestMultiHeightSnapshot(t *testing.T) {
+	heights := []uint64{1, 3, 9}
+	// take individual snapshots to compare against
+	var expectedStateNodes []string
+	expectedIplds := make(map[string]struct{})
+	for _, height := range heights {
+		data := doSnapshot(t, fixture.ChainA, SnapshotParams{Height: height, Workers: 4})
+		for _, node := range data.StateNodes {
+			expectedStateNodes = append(expectedStateNodes, node.AccountWrapper.CID)
+		}
+		for _, ipld := range data.IPLDs {
+			expectedIplds[ipld.CID] = struct{}{}
+		}
+	}
+
+	runCase := func(t *testing.T, workers uint) {
+		params := SnapshotParams{Heights: heights, Workers: workers}
+		data := doSnapshot(t, fixture.ChainA, params)
+
+		for _, height := range heights {
+			require.Contains(t, data.Headers, height)
+		}
+		var indexedStateNodes []string
+		for _, node := range data.StateNodes {
+			indexedStateNodes = append(indexedStateNodes, node.AccountWrapper.CID)
+		}
+		require.ElementsMatch(t, expectedStateNodes, indexedStateNodes)
+
+		// each IPLD should only be pushed once
+		ipldCids := make(map[string]struct{})
+		for _, ipld := range data.IPLDs {
+			require.NotContains(t, ipldCids, ipld.CID, "duplicate IPLD")
+			ipldCids[ipld.CID] = struct{}{}
+		}
+		require.Equal(t, expectedIplds, ipldCids)
+	}
+
+	for _, tc := range subtrieWorkerCases {
+		t.Run(fmt.Sprintf("with %d subtries", tc), func(t *testing.T) { runCase(t, tc) })
+	}
+}
+
+func TestMultiHeightSnapshotDedupSize(t *testing.T) {
+	edb := openEthDB(t, fixture.ChainA)
+	heights := []uint64{1, 3, 9}
+	expectedIplds := make(map[string]struct{})
+	var total int
+	for _, height := range heights {
+		data := doSnapshot(t, fixture.ChainA, SnapshotParams{Height: height, Workers: 4})
+		for _, ipld := range data.IPLDs {
+			expectedIplds[ipld.CID] = struct{}{}
+		}
+		total += len(data.IPLDs)
+	}
+
+	for _, size := range []uint{0, 1, 16} {
+		t.Run(fmt.Sprintf("remembering %d CIDs", size), func(t *testing.T) {
+			idx := mocks.NewIndexer(t)
+			service, err := NewSnapshotService(edb, idx, filepath.Join(t.TempDir(), "recover.csv"))
+			require.NoError(t, err)
+			service.SetDedupSize(size)
+			service.SetCommitInterval(4)
+			_, err = service.CreateSnapshot(context.Background(), SnapshotParams{Heights: heights, Workers: 4})
+			require.NoError(t, err)
+
+			// IPLDs which are forgotten are written again, but none are missed
+			require.Equal(t, expectedIplds, cidSet(idx.IndexerData))
+			if size == 0 {
+				require.Len(t, idx.IPLDs, total)
+			}
+		})
+	}
+}
+
+func TestDeltaSnapshot(t *testing.T) {
+	var fromHeight, toHeight uint64 = 3, 22
+	fromData := doSnapshot(t, fixture.ChainA, SnapshotParams{Height: fromHeight, Workers: 4})
+	toData := doSnapshot(t, fixture.ChainA, SnapshotParams{Height: toHeight, Workers: 4})
+
+	// accounts are only included in the diff if their value changed
+	fromAccounts := make(map[string]string)
+	for _, node := range fromData.StateNodes {
+		fromAccounts[string(node.AccountWrapper.LeafKey)] = encodeAccount(t, node.AccountWrapper.Account)
+	}
+	toAccounts := make(map[string]string)
+	toNodes := make(map[string]string)
+	for _, node := range toData.StateNodes {
+		toAccounts[string(node.AccountWrapper.LeafKey)] = encodeAccount(t, node.AccountWrapper.Account)
+		toNodes[string(node.AccountWrapper.LeafKey)] = node.AccountWrapper.CID
+	}
+	fromIplds := make(map[string]struct{})
+	for _, ipld := range fromData.IPLDs {
+		fromIplds[ipld.CID] = struct{}{}
+	}
+	toIplds := make(map[string]struct{})
+	for _, ipld := range toData.IPLDs {
+		toIplds[ipld.CID] = struct{}{}
+	}
+
+	runCase := func(t *testing.T, workers uint) {
+		params := DeltaParams{FromHeight: fromHeight, ToHeight: toHeight, Workers: workers}
+		data := doDeltaSnapshot(t, fixture.ChainA, params)
+		require.Contains(t, data.Headers, toHeight)
+
+		deltaAccounts := make(map[string]struct{})
+		for _, node := range data.StateNodes {
+			key := string(node.AccountWrapper.LeafKey)
+			if node.Removed {
+				require.NotContains(t, toNodes, key, "removed node still present")
+				continue
+			}
+			require.Equal(t, toNodes[key], node.AccountWrapper.CID)
+			deltaAccounts[key] = struct{}{}
+		}
+		// every new or updated account must be in the delta
+		for key, account := range toAccounts {
+			if fromAccounts[key] != account {
+				require.Contains(t, deltaAccounts, key, "missing state node")
+			}
+		}
+
+		deltaIplds := make(map[string]struct{})
+		for _, ipld := range data.IPLDs {
+			require.Contains(t, toIplds, ipld.CID, "unexpected IPLD")
+			deltaIplds[ipld.CID] = struct{}{}
+		}
+		for cid := range toIplds {
+			if _, has := fromIplds[cid]; !has {
+				require.Contains(t, deltaIplds, cid, "missing IPLD")
+			}
+		}
+	}
+
+	for _, tc := range subtrieWorkerCases {
+		t.Run(fmt.Sprintf("with %d subtries", tc), func(t *testing.T) { runCase(t, tc) })
+	}
+}
+
+func TestDeltaSnapshotCancel(t *testing.T) {
+	params := DeltaParams{FromHeight: 3, ToHeight: 22, Workers: 4}
+	total := len(doDeltaSnapshot(t, fixture.ChainA, params).StateNodes)
+	edb := openEthDB(t, fixture.ChainA)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	idx := &cancellingIndexer{TxIndexer: mocks.NewTxIndexer(t), cancel: cancel, cancelAfter: 1}
+	service, err := NewSnapshotService(edb, idx, "")
+	require.NoError(t, err)
+	// hold the builder back until each record is written, so that it is still running when the
+	// context is cancelled
+	service.SetBatchSize(1, 0)
+	service.SetWriters(1, 1)
+	err = service.CreateDeltaSnapshot(ctx, params)
+	require.ErrorIs(t, err, context.Canceled)
+	// the builder stopped before emitting the whole diff, which was rolled back
+	require.Less(t, int(idx.pushed), total)
+	require.Zero(t, idx.Commits)
+	require.Equal(t, 1, idx.Rollbacks)
+}
+
+func TestStateDiffRange(t *testing.T) {
+	var start, end uint64 = 1, 16
+	baseData := doSnapshot(t, fixture.ChainA, SnapshotParams{Height: start - 1, Workers: 1})
+	endData := doSnapshot(t, fixture.ChainA, SnapshotParams{Height: end, Workers: 1})
+
+	runCase := func(t *testing.T, workers uint) {
+		params := StateDiffRangeParams{Start: start, End: end, Workers: workers}
+		data := doStateDiffs(t, fixture.ChainA, params)
+		for height := start; height <= end; height++ {
+			require.Contains(t, data.Headers, height)
+		}
+
+		// applying the diffs to the base snapshot must yield every node of the end state
+		iplds := make(map[string]struct{})
+		for _, ipld := range baseData.IPLDs {
+			iplds[ipld.CID] = struct{}{}
+		}
+		for _, ipld := range data.IPLDs {
+			iplds[ipld.CID] = struct{}{}
+		}
+		for _, ipld := range endData.IPLDs {
+			require.Contains(t, iplds, ipld.CID, "missing IPLD")
+		}
+	}
+
+	for _, tc := range subtrieWorkerCases {
+		t.Run(fmt.Sprintf("with %d subtries", tc), func(t *testing.T) { runCase(t, tc) })
+	}
+}
+
 func TestSnapshotRecovery(t *testing.T) {
 	runCase := func(t *testing.T, workers uint, interruptAt uint) {
 		params := SnapshotParams{Height: 1, Workers: workers}
@@ -98,6 +327,411 @@ func TestSnapshotRecovery(t *testing.T) {
 	}
 }
 
+func TestSnapshotChunkedCommits(t *testing.T) {
+	runSnapshotCases(t, []snapshotCase{{
+		name:      "commit interval 8",
+		params:    SnapshotParams{Height: 1, Workers: 4},
+		configure: func(service *Service) { service.SetCommitInterval(8) },
+		verify: func(t *testing.T, idx *mocks.TxIndexer, _ []*SnapshotResult) {
+			verify_chainAblock1(t, idx.IndexerData)
+			// at least one commit per subtrie
+			require.Greater(t, idx.Commits, 4)
+		},
+	}})
+}
+
+func TestSnapshotBatchSize(t *testing.T) {
+	var cases []snapshotCase
+	for _, size := range []struct{ records, bytes uint }{
+		{1, 0},
+		{7, 0},
+		{1000, 0},
+		{1000, 2048},
+	} {
+		size := size
+		cases = append(cases, snapshotCase{
+			name:   fmt.Sprintf("%d records, %d bytes", size.records, size.bytes),
+			params: SnapshotParams{Height: 1, Workers: 4},
+			configure: func(service *Service) {
+				service.SetBatchSize(size.records, size.bytes)
+				service.SetCommitInterval(16)
+			},
+			verify: func(t *testing.T, idx *mocks.TxIndexer, results []*SnapshotResult) {
+				verify_chainAblock1(t, idx.IndexerData)
+				require.Equal(t, uint64(len(idx.IPLDs)), results[0].IPLDs)
+			},
+		})
+	}
+	runSnapshotCases(t, cases)
+}
+
+func TestSnapshotWriters(t *testing.T) {
+	var cases []snapshotCase
+	for _, tc := range []struct{ writers, queueLength uint }{
+		{1, 1},
+		{3, 16},
+		{8, 1024},
+	} {
+		tc := tc
+		cases = append(cases, snapshotCase{
+			name:   fmt.Sprintf("%d writers, queue length %d", tc.writers, tc.queueLength),
+			params: SnapshotParams{Height: 1, Workers: 4},
+			configure: func(service *Service) {
+				service.SetWriters(tc.writers, tc.queueLength)
+				service.SetBatchSize(4, 0)
+				service.SetCommitInterval(8)
+			},
+			verify: func(t *testing.T, idx *mocks.TxIndexer, results []*SnapshotResult) {
+				verify_chainAblock1(t, idx.IndexerData)
+				require.Equal(t, uint64(len(fixture.ChainA_Block1_StateNodeLeafKeys)), results[0].StateNodes)
+				require.Equal(t, uint64(len(idx.IPLDs)), results[0].IPLDs)
+			},
+		})
+	}
+	runSnapshotCases(t, cases)
+}
+
+func TestSnapshotFailure(t *testing.T) {
+	edb := openEthDB(t, fixture.ChainA)
+	header := rawdb.ReadHeader(edb, rawdb.ReadCanonicalHash(edb, 1), 1)
+	outputDir := t.TempDir()
+	marker := filepath.Join(outputDir, fmt.Sprintf("%d_%s.incomplete", 1, header.Hash().Hex()))
+	params := SnapshotParams{Height: 1, Workers: 4}
+
+	runSnapshotCases(t, []snapshotCase{{
+		name:           "interrupted",
+		params:         params,
+		interruptAfter: uint(len(fixture.ChainA_Block1_StateNodeLeafKeys) / 2),
+		configure:      func(service *Service) { service.SetCatalog(NewFileCatalog(outputDir)) },
+		interrupted: func(t *testing.T, idx *mocks.InterruptingIndexer, _ string) {
+			// the uncommitted chunks are rolled back, at most one per writer, and the snapshot is
+			// marked as incomplete
+			require.NotZero(t, idx.Rollbacks)
+			require.LessOrEqual(t, idx.Rollbacks, int(params.Workers))
+			require.FileExists(t, marker)
+			content, err := os.ReadFile(marker)
+			require.NoError(t, err)
+			require.Contains(t, string(content), "mock interrupt")
+		},
+		verify: func(t *testing.T, idx *mocks.TxIndexer, _ []*SnapshotResult) {
+			verify_chainAblock1(t, idx.IndexerData)
+			require.NoFileExists(t, marker)
+		},
+	}})
+}
+
+// cancellingIndexer cancels a context once a number of state nodes have been pushed
+type cancellingIndexer struct {
+	*mocks.TxIndexer
+	cancel      func()
+	cancelAfter uint
+	pushed      uint
+}
+
+func (i *cancellingIndexer) PushStateNode(b indexer.Batch, node sdtypes.StateLeafNode, h string) error {
+	i.Lock()
+	i.pushed++
+	if i.pushed == i.cancelAfter {
+		i.cancel()
+	}
+	i.Unlock()
+	return i.TxIndexer.PushStateNode(b, node, h)
+}
+
+func TestSnapshotCancel(t *testing.T) {
+	edb := openEthDB(t, fixture.ChainA)
+	recoveryFile := filepath.Join(t.TempDir(), "recover.csv")
+	params := SnapshotParams{Height: 1, Workers: 4}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	idx := &cancellingIndexer{
+		TxIndexer:   mocks.NewTxIndexer(t),
+		cancel:      cancel,
+		cancelAfter: uint(len(fixture.ChainA_Block1_StateNodeLeafKeys) / 2),
+	}
+	service, err := NewSnapshotService(edb, idx, recoveryFile)
+	require.NoError(t, err)
+	// hold the workers back until each record is written, so that they are still running when the
+	// context is cancelled
+	service.SetBatchSize(1, 0)
+	service.SetWriters(1, 1)
+	_, err = service.CreateSnapshot(ctx, params)
+	require.ErrorIs(t, err, context.Canceled)
+	// what was written before the cancellation is kept, to be resumed
+	require.Zero(t, idx.Rollbacks)
+	require.FileExists(t, recoveryFile)
+
+	// a context which is already done stops the snapshot before it starts
+	expired, cancelExpired := context.WithDeadline(context.Background(), time.Now())
+	defer cancelExpired()
+	_, err = service.CreateSnapshot(expired, params)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.FileExists(t, recoveryFile)
+
+	service, err = NewSnapshotService(edb, idx.TxIndexer, recoveryFile)
+	require.NoError(t, err)
+	_, err = service.CreateSnapshot(context.Background(), params)
+	require.NoError(t, err)
+	verify_chainAblock1(t, idx.IndexerData)
+	require.NoFileExists(t, recoveryFile)
+}
+
+func TestSnapshotRecoveryMismatch(t *testing.T) {
+	edb := openEthDB(t, fixture.ChainA)
+	header := rawdb.ReadHeader(edb, rawdb.ReadCanonicalHash(edb, 1), 1)
+	recoveryFile := filepath.Join(t.TempDir(), "recover.csv")
+	params := SnapshotParams{Height: 1, Workers: 4}
+
+	idx := &mocks.InterruptingIndexer{
+		TxIndexer:      mocks.NewTxIndexer(t),
+		InterruptAfter: uint(len(fixture.ChainA_Block1_StateNodeLeafKeys) / 2),
+	}
+	service, err := NewSnapshotService(edb, idx, recoveryFile)
+	require.NoError(t, err)
+	service.SetBatchSize(1, 0)
+	service.SetCommitInterval(1)
+	_, err = service.CreateSnapshot(context.Background(), params)
+	require.ErrorContains(t, err, "mock interrupt")
+	recovery, err := os.ReadFile(recoveryFile)
+	require.NoError(t, err)
+	require.True(t, bytes.HasPrefix(recovery, []byte("#version,3\n")))
+	require.Contains(t, string(recovery), "#state_root,"+header.Root.Hex())
+	require.Contains(t, string(recovery), "#block_hash,"+header.Hash().Hex())
+
+	written := len(idx.StateNodes)
+	watched := SnapshotParams{Height: 1, Workers: 4, WatchedAddresses: []common.Address{common.HexToAddress("0x01")}}
+	service, err = NewSnapshotService(edb, idx.TxIndexer, recoveryFile)
+	require.NoError(t, err)
+	_, err = service.CreateSnapshot(context.Background(), watched)
+	require.ErrorIs(t, err, ErrRecoveryMismatch)
+	// nothing is written, and the file is kept to be resumed
+	require.Len(t, idx.StateNodes, written)
+	require.FileExists(t, recoveryFile)
+
+	service, err = NewSnapshotService(edb, idx.TxIndexer, recoveryFile)
+	require.NoError(t, err)
+	service.SetOutputLocation("elsewhere")
+	_, err = service.CreateSnapshot(context.Background(), params)
+	require.ErrorIs(t, err, ErrRecoveryMismatch)
+	require.FileExists(t, recoveryFile)
+
+	// the file can be discarded to start over
+	service, err = NewSnapshotService(edb, idx.TxIndexer, recoveryFile)
+	require.NoError(t, err)
+	service.SetOutputLocation("elsewhere")
+	service.SetRecoveryMismatchPolicy(RestartOnMismatch)
+	_, err = service.CreateSnapshot(context.Background(), params)
+	require.NoError(t, err)
+	verify_chainAblock1(t, idx.IndexerData)
+	require.NoFileExists(t, recoveryFile)
+}
+
+func TestSnapshotResumeWorkers(t *testing.T) {
+	var cases []snapshotCase
+	for _, workers := range []uint{1, 3, 16} {
+		workers := workers
+		var recorder *progressRecorder
+		cases = append(cases, snapshotCase{
+			name:           fmt.Sprintf("%d workers", workers),
+			params:         SnapshotParams{Height: 1, Workers: 2},
+			interruptAfter: uint(len(fixture.ChainA_Block1_StateNodeLeafKeys) / 2),
+			resumeWorkers:  workers,
+			configure: func(service *Service) {
+				service.SetBatchSize(1, 0)
+				service.SetCommitInterval(1)
+				// the recorder of the last run is kept
+				recorder = &progressRecorder{}
+				service.SetProgressObserver(recorder, time.Hour)
+			},
+			verify: func(t *testing.T, idx *mocks.TxIndexer, _ []*SnapshotResult) {
+				verify_chainAblock1(t, idx.IndexerData)
+				// the saved ranges are divided among the new workers
+				require.GreaterOrEqual(t, len(recorder.started), int(workers))
+			},
+		})
+	}
+	runSnapshotCases(t, cases)
+}
+
+// memRecoveryStore holds recovery checkpoints in memory
+type memRecoveryStore struct {
+	sync.Mutex
+	rows map[string][][]string
+}
+
+func (m *memRecoveryStore) Load(_ context.Context, name string) ([][]string, error) {
+	m.Lock()
+	defer m.Unlock()
+	return m.rows[name], nil
+}
+
+func (m *memRecoveryStore) Save(_ context.Context, name string, rows [][]string) error {
+	m.Lock()
+	defer m.Unlock()
+	m.rows[name] = rows
+	return nil
+}
+
+func (m *memRecoveryStore) Remove(_ context.Context, name string) error {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.rows, name)
+	return nil
+}
+
+func TestSnapshotRecoveryStore(t *testing.T) {
+	store := &memRecoveryStore{rows: make(map[string][][]string)}
+	runSnapshotCases(t, []snapshotCase{{
+		name:           "interrupted",
+		params:         SnapshotParams{Height: 1, Workers: 4},
+		interruptAfter: uint(len(fixture.ChainA_Block1_StateNodeLeafKeys) / 2),
+		configure: func(service *Service) {
+			service.SetRecoveryStore(store)
+			service.SetBatchSize(1, 0)
+			service.SetCommitInterval(1)
+		},
+		interrupted: func(t *testing.T, _ *mocks.InterruptingIndexer, recoveryFile string) {
+			require.NoFileExists(t, recoveryFile)
+			require.Contains(t, store.rows, recoveryFile)
+			require.Equal(t, []string{"#version", "3"}, store.rows[recoveryFile][0])
+		},
+		verify: func(t *testing.T, idx *mocks.TxIndexer, _ []*SnapshotResult) {
+			verify_chainAblock1(t, idx.IndexerData)
+			require.Empty(t, store.rows)
+		},
+	}})
+}
+
+// txRecoveryStore keeps the checkpoint committed by each writer with its batch of the mock indexer
+type txRecoveryStore struct {
+	sync.Mutex
+	writers map[string]map[int]txCheckpoint
+	// saves counts the checkpoints saved apart from the data
+	saves int
+}
+
+type txCheckpoint struct {
+	seq  uint64
+	rows [][]string
+}
+
+func (m *txRecoveryStore) Load(_ context.Context, name string) ([][]string, error) {
+	m.Lock()
+	defer m.Unlock()
+	var earliest *txCheckpoint
+	for writer := 0; writer < len(m.writers[name]); writer++ {
+		if cp := m.writers[name][writer]; earliest == nil || cp.seq < earliest.seq {
+			earliest = &cp
+		}
+	}
+	if earliest == nil {
+		return nil, nil
+	}
+	return earliest.rows, nil
+}
+
+func (m *txRecoveryStore) Save(ctx context.Context, name string, rows [][]string) error {
+	m.Lock()
+	m.saves++
+	m.Unlock()
+	return m.Reset(ctx, name, 1, rows)
+}
+
+func (m *txRecoveryStore) Reset(_ context.Context, name string, writers int, rows [][]string) error {
+	m.Lock()
+	defer m.Unlock()
+	m.writers[name] = make(map[int]txCheckpoint)
+	for writer := 0; writer < writers; writer++ {
+		m.writers[name][writer] = txCheckpoint{rows: rows}
+	}
+	return nil
+}
+
+func (m *txRecoveryStore) SaveTx(tx indexer.Batch, name string, writer int, seq uint64, rows [][]string) error {
+	tx.(*mocks.TxBatch).OnSubmit(func() {
+		m.Lock()
+		defer m.Unlock()
+		m.writers[name][writer] = txCheckpoint{seq: seq, rows: rows}
+	})
+	return nil
+}
+
+func (m *txRecoveryStore) Remove(_ context.Context, name string) error {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.writers, name)
+	return nil
+}
+
+func TestSnapshotRecoveryTxStore(t *testing.T) {
+	store := &txRecoveryStore{writers: make(map[string]map[int]txCheckpoint)}
+	runSnapshotCases(t, []snapshotCase{{
+		name:           "interrupted",
+		params:         SnapshotParams{Height: 1, Workers: 4},
+		interruptAfter: uint(len(fixture.ChainA_Block1_StateNodeLeafKeys) / 2),
+		configure: func(service *Service) {
+			service.SetRecoveryStore(store)
+			service.SetBatchSize(1, 0)
+			service.SetCommitInterval(1)
+		},
+		interrupted: func(t *testing.T, _ *mocks.InterruptingIndexer, recoveryFile string) {
+			require.NoFileExists(t, recoveryFile)
+			// each writer committed its checkpoints with its data, and none was saved apart from it
+			require.Len(t, store.writers[recoveryFile], 4)
+			committed := false
+			for _, cp := range store.writers[recoveryFile] {
+				committed = committed || cp.seq != 0
+			}
+			require.True(t, committed, "no checkpoint was committed")
+			require.Zero(t, store.saves)
+		},
+		verify: func(t *testing.T, idx *mocks.TxIndexer, _ []*SnapshotResult) {
+			verify_chainAblock1(t, idx.IndexerData)
+			require.Empty(t, store.writers)
+			require.Zero(t, store.saves)
+		},
+	}})
+}
+
+// slowIndexer delays each IPLD, so that a snapshot takes long enough for timed checkpoints
+type slowIndexer struct {
+	storageIndexer
+	delay time.Duration
+}
+
+func (i *slowIndexer) PushIPLD(b indexer.Batch, ipld sdtypes.IPLD) error {
+	time.Sleep(i.delay)
+	return i.storageIndexer.PushIPLD(b, ipld)
+}
+
+func TestSnapshotCheckpointInterval(t *testing.T) {
+	runSnapshotCases(t, []snapshotCase{{
+		name:           "interrupted",
+		params:         SnapshotParams{Height: 1, Workers: 1},
+		interruptAfter: uint(len(fixture.ChainA_Block1_StateNodeLeafKeys) / 2),
+		configure: func(service *Service) {
+			service.SetBatchSize(1, 0)
+			// a short queue keeps the iterators from running ahead of the writer, so that
+			// checkpoints are queued before the interrupt
+			service.SetWriters(1, 1)
+			service.SetCheckpointInterval(5 * time.Millisecond)
+		},
+		wrap: func(idx storageIndexer) indexer.Indexer {
+			return &slowIndexer{storageIndexer: idx, delay: 100 * time.Microsecond}
+		},
+		interrupted: func(t *testing.T, idx *mocks.InterruptingIndexer, recoveryFile string) {
+			// with a single subtrie and no commit interval, only the timed checkpoints were saved
+			require.NotZero(t, len(idx.StateNodes))
+			require.FileExists(t, recoveryFile)
+			// the file is replaced without leaving temporary files behind
+			entries, err := os.ReadDir(filepath.Dir(recoveryFile))
+			require.NoError(t, err)
+			require.Len(t, entries, 1)
+		},
+	}})
+}
+
 func TestAccountSelectiveSnapshotRecovery(t *testing.T) {
 	height := uint64(32)
 	watchedAddresses, expected := watchedAccountData_chainBblock32()
@@ -120,6 +754,251 @@ func TestAccountSelectiveSnapshotRecovery(t *testing.T) {
 	}
 }
 
+func TestSnapshotStorageSplit(t *testing.T) {
+	watchedAddresses, expected := watchedAccountData_chainBblock32()
+	// take a snapshot without dividing storage to compare against
+	whole := doSnapshot(t, fixture.ChainB, SnapshotParams{Height: 32, Workers: 1})
+
+	var cases []snapshotCase
+	for _, workers := range []uint{2, 4, 8} {
+		for _, watched := range [][]common.Address{nil, watchedAddresses} {
+			tc := snapshotCase{
+				name:   fmt.Sprintf("with %d workers, %d watched", workers, len(watched)),
+				chain:  fixture.ChainB,
+				params: SnapshotParams{Height: 32, Workers: workers, WatchedAddresses: watched},
+				configure: func(service *Service) {
+					service.SetStorageSplit(1)
+					service.SetCommitInterval(2)
+				},
+				verify: func(t *testing.T, idx *mocks.TxIndexer, _ []*SnapshotResult) {
+					require.Equal(t, storageSets(whole), storageSets(idx.IndexerData))
+					require.Equal(t, cidSet(whole), cidSet(idx.IndexerData))
+				},
+			}
+			if watched != nil {
+				tc.verify = func(t *testing.T, idx *mocks.TxIndexer, _ []*SnapshotResult) {
+					expected.verify(t, idx.IndexerData)
+				}
+			}
+			cases = append(cases, tc)
+		}
+	}
+	runSnapshotCases(t, cases)
+}
+
+func TestSnapshotStorageSplitStateNodes(t *testing.T) {
+	whole := doSnapshot(t, fixture.ChainB, SnapshotParams{Height: 32, Workers: 1})
+
+	// every state node pushed is recorded, so repeated state rows would show
+	var rec *pushRecorder
+	runSnapshotCases(t, []snapshotCase{{
+		name:   "4 workers",
+		chain:  fixture.ChainB,
+		params: SnapshotParams{Height: 32, Workers: 4},
+		configure: func(service *Service) {
+			service.SetStorageSplit(1)
+			service.SetCommitInterval(2)
+		},
+		wrap: func(idx storageIndexer) indexer.Indexer {
+			rec = &pushRecorder{storageIndexer: idx}
+			return rec
+		},
+		verify: func(t *testing.T, idx *mocks.TxIndexer, results []*SnapshotResult) {
+			rows := make(map[string]int)
+			for _, key := range rec.state {
+				rows[common.BytesToHash(key).String()]++
+			}
+			for key, n := range rows {
+				require.Equal(t, 1, n, "state node %s written %d times", key, n)
+			}
+			require.Len(t, rows, len(whole.StateNodes))
+			require.Equal(t, uint64(len(whole.StateNodes)), results[0].StateNodes)
+			require.Equal(t, storageSets(whole), storageSets(idx.IndexerData))
+		},
+	}})
+}
+
+func TestSnapshotStorageSplitRecovery(t *testing.T) {
+	watchedAddresses, expected := watchedAccountData_chainBblock32()
+	params := SnapshotParams{Height: 32, Workers: 4, WatchedAddresses: watchedAddresses}
+
+	resumedStorage := false
+	var cases []snapshotCase
+	// the storage of the two watched accounts is divided, and the accounts and each of their 7 slots
+	// are pushed separately
+	for interruptAt := uint(1); interruptAt < 9; interruptAt++ {
+		var saved [][]string
+		var rec *pushRecorder
+		cases = append(cases, snapshotCase{
+			name:           fmt.Sprintf("interrupted after %d", interruptAt),
+			chain:          fixture.ChainB,
+			params:         params,
+			interruptAfter: interruptAt,
+			configure: func(service *Service) {
+				service.SetStorageSplit(1)
+				service.SetBatchSize(1, 0)
+				service.SetCommitInterval(1)
+			},
+			// the recorder of the last run is kept
+			wrap: func(idx storageIndexer) indexer.Indexer {
+				rec = &pushRecorder{storageIndexer: idx}
+				return rec
+			},
+			interrupted: func(t *testing.T, _ *mocks.InterruptingIndexer, recoveryFile string) {
+				recovery, err := os.ReadFile(recoveryFile)
+				require.NoError(t, err)
+				for _, row := range strings.Split(strings.TrimSpace(string(recovery)), "\n") {
+					if cols := strings.Split(row, ","); !strings.HasPrefix(row, "#") && len(cols) == 5 {
+						saved = append(saved, cols)
+					}
+				}
+				resumedStorage = resumedStorage || len(saved) != 0
+			},
+			verify: func(t *testing.T, idx *mocks.TxIndexer, _ []*SnapshotResult) {
+				expected.verify(t, idx.IndexerData)
+				// the storage leaves written on resume are those from the saved positions of the
+				// unfinished ranges, which start after the last leaf written before the interruption
+				for _, pushed := range rec.storage {
+					account, key := fmt.Sprintf("%x", pushed[0]), fmt.Sprintf("%x", keyNibbles(pushed[1]))
+					resumed, unfinished := false, false
+					for _, row := range saved {
+						if row[3] == account {
+							resumed = true
+							unfinished = unfinished || key >= row[0] && (row[1] == "" || key < row[1])
+						}
+					}
+					require.True(t, !resumed || unfinished, "storage leaf %x written again", pushed[1])
+				}
+			},
+		})
+	}
+	runSnapshotCases(t, cases)
+	require.True(t, resumedStorage, "no storage range was saved to the recovery file")
+}
+
+func TestSnapshotResumeUnstartedSplit(t *testing.T) {
+	// resume with a range split off from the first which had not started, past the last account
+	unstarted := []string{"0f0f0f0f0f0f0f00", "", "0f0f0f0f0f0f0f"}
+	var rec *pushRecorder
+	runSnapshotCases(t, []snapshotCase{{
+		name:     "single worker",
+		params:   SnapshotParams{Height: 1, Workers: 1},
+		recovery: "#version,3\n,0f0f0f0f0f0f0f,\n" + strings.Join(unstarted, ",") + "\n",
+		// the single worker is interrupted in the first range, so the second is saved before it runs
+		interruptAfter: 4,
+		configure: func(service *Service) {
+			service.SetRecoveryMismatchPolicy(ResumeOnMismatch)
+			service.SetBatchSize(1, 0)
+			service.SetCommitInterval(1)
+		},
+		// the recorder of the last run is kept
+		wrap: func(idx storageIndexer) indexer.Indexer {
+			rec = &pushRecorder{storageIndexer: idx}
+			return rec
+		},
+		interrupted: func(t *testing.T, _ *mocks.InterruptingIndexer, recoveryFile string) {
+			recovery, err := os.ReadFile(recoveryFile)
+			require.NoError(t, err)
+			require.Contains(t, strings.Split(string(recovery), "\n"), strings.Join(unstarted, ","))
+		},
+		verify: func(t *testing.T, idx *mocks.TxIndexer, _ []*SnapshotResult) {
+			verify_chainAblock1(t, idx.IndexerData)
+			// no node before the start of the unstarted range is emitted from it
+			pushed := make(map[string]int)
+			for _, key := range rec.state {
+				pushed[string(key)]++
+				require.Equal(t, 1, pushed[string(key)], "state node %x written again", key)
+			}
+		},
+	}})
+}
+
+func TestSnapshotWorkStealing(t *testing.T) {
+	recorder := &progressRecorder{}
+	runSnapshotCases(t, []snapshotCase{{
+		name:   "2 workers",
+		params: SnapshotParams{Height: 1, Workers: 2},
+		// resume with one worker's range holding only the root and the node at path 0, and the
+		// other holding the rest of the trie
+		recovery: ",00\n0000,\n",
+		configure: func(service *Service) {
+			// the file has no identity rows
+			service.SetRecoveryMismatchPolicy(ResumeOnMismatch)
+			service.SetProgressObserver(recorder, time.Hour)
+			// hold the workers back until each record is written, so that the busy worker is still
+			// running once the other is done
+			service.SetBatchSize(1, 0)
+			service.SetWriters(1, 1)
+			service.SetCommitInterval(1)
+		},
+		verify: func(t *testing.T, idx *mocks.TxIndexer, _ []*SnapshotResult) {
+			verify_chainAblock1(t, idx.IndexerData)
+			require.Greater(t, len(recorder.started), 2, "no range was split off")
+			require.Len(t, recorder.finished, len(recorder.started))
+		},
+	}})
+}
+
+// pushRecorder records the leaf keys of the state nodes pushed, and of the storage nodes pushed
+// apart from their account, including those which are not committed.
+type pushRecorder struct {
+	storageIndexer
+	mtx   sync.Mutex
+	state [][]byte
+	// storage holds the state and storage leaf key of each storage node
+	storage [][2][]byte
+}
+
+func (r *pushRecorder) PushStateNode(b indexer.Batch, node sdtypes.StateLeafNode, h string) error {
+	r.mtx.Lock()
+	r.state = append(r.state, node.AccountWrapper.LeafKey)
+	r.mtx.Unlock()
+	return r.storageIndexer.PushStateNode(b, node, h)
+}
+
+func (r *pushRecorder) PushStorageNodes(
+	b indexer.Batch, stateKey []byte, nodes []sdtypes.StorageLeafNode, h string,
+) error {
+	r.mtx.Lock()
+	for _, node := range nodes {
+		r.storage = append(r.storage, [2][]byte{stateKey, node.LeafKey})
+	}
+	r.mtx.Unlock()
+	return r.storageIndexer.PushStorageNodes(b, stateKey, nodes, h)
+}
+
+// keyNibbles returns the path of a leaf key, as hex nibbles.
+func keyNibbles(key []byte) []byte {
+	nibbles := make([]byte, 0, 2*len(key))
+	for _, b := range key {
+		nibbles = append(nibbles, b>>4, b&0xf)
+	}
+	return nibbles
+}
+
+// storageSets maps the leaf key of each state node to the set of its storage leaf keys.
+func storageSets(data mocks.IndexerData) map[string]map[string]struct{} {
+	sets := make(map[string]map[string]struct{})
+	for _, node := range data.StateNodes {
+		stateKey := common.BytesToHash(node.AccountWrapper.LeafKey).String()
+		if sets[stateKey] == nil {
+			sets[stateKey] = make(map[string]struct{})
+		}
+		for _, storage := range node.StorageDiff {
+			sets[stateKey][common.BytesToHash(storage.LeafKey).String()] = struct{}{}
+		}
+	}
+	return sets
+}
+
+func cidSet(data mocks.IndexerData) map[string]struct{} {
+	cids := make(map[string]struct{})
+	for _, ipld := range data.IPLDs {
+		cids[ipld.CID] = struct{}{}
+	}
+	return cids
+}
+
 func verify_chainAblock1(t *testing.T, data mocks.IndexerData) {
 	// Extract indexed keys and sort them for comparison
 	var indexedStateKeys []string
@@ -205,6 +1084,90 @@ func (expected selectiveData) verify(t *testing.T, data mocks.IndexerData) {
 	}
 }
 
+// storageIndexer is a mock indexer which can write storage nodes apart from their account
+type storageIndexer interface {
+	indexer.Indexer
+	StorageIndexer
+}
+
+// snapshotCase is a snapshot taken with a mock indexer, which is first interrupted and then resumed
+// if interruptAfter is set
+type snapshotCase struct {
+	name string
+	// chain defaults to chain A
+	chain  *chains.Paths
+	params SnapshotParams
+	// recovery is written to the recovery file before the first run
+	recovery string
+	// interruptAfter is the number of state nodes after which the first run is interrupted
+	interruptAfter uint
+	// resumeWorkers, if set, replaces the number of workers of the resumed run
+	resumeWorkers uint
+	// configure is applied to the service of each run
+	configure func(service *Service)
+	// wrap, if set, wraps the indexer of each run
+	wrap func(idx storageIndexer) indexer.Indexer
+	// interrupted checks the outcome of the interrupted run
+	interrupted func(t *testing.T, idx *mocks.InterruptingIndexer, recoveryFile string)
+	// verify checks the data committed by the completed run, and defaults to verifying block 1 of
+	// chain A
+	verify func(t *testing.T, idx *mocks.TxIndexer, results []*SnapshotResult)
+}
+
+// runSnapshotCases takes the snapshot of each case in a subtest, and checks that it completes and
+// its recovery file is removed.
+func runSnapshotCases(t *testing.T, cases []snapshotCase) {
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			chain := tc.chain
+			if chain == nil {
+				chain = fixture.ChainA
+			}
+			edb := openEthDB(t, chain)
+			recoveryFile := filepath.Join(t.TempDir(), "recover.csv")
+			if tc.recovery != "" {
+				require.NoError(t, os.WriteFile(recoveryFile, []byte(tc.recovery), 0644))
+			}
+			run := func(idx storageIndexer, params SnapshotParams) ([]*SnapshotResult, error) {
+				var ind indexer.Indexer = idx
+				if tc.wrap != nil {
+					ind = tc.wrap(idx)
+				}
+				service, err := NewSnapshotService(edb, ind, recoveryFile)
+				require.NoError(t, err)
+				if tc.configure != nil {
+					tc.configure(service)
+				}
+				return service.CreateSnapshot(context.Background(), params)
+			}
+
+			idx := mocks.NewTxIndexer(t)
+			params := tc.params
+			if tc.interruptAfter != 0 {
+				interrupting := &mocks.InterruptingIndexer{TxIndexer: idx, InterruptAfter: tc.interruptAfter}
+				_, err := run(interrupting, params)
+				require.ErrorContains(t, err, "mock interrupt")
+				if tc.interrupted != nil {
+					tc.interrupted(t, interrupting, recoveryFile)
+				}
+				if tc.resumeWorkers != 0 {
+					params.Workers = tc.resumeWorkers
+				}
+			}
+
+			// the nested mock indexer continues from what was committed
+			results, err := run(idx, params)
+			require.NoError(t, err)
+			require.NoFileExists(t, recoveryFile)
+			if tc.verify != nil {
+				tc.verify(t, idx, results)
+			} else {
+				verify_chainAblock1(t, idx.IndexerData)
+			}
+		})
+	}
+}
+
 func doSnapshot(t *testing.T, chain *chains.Paths, params SnapshotParams) mocks.IndexerData {
 	chainDataPath, ancientDataPath := chain.ChainData, chain.Ancient
 	config := testConfig(chainDataPath, ancientDataPath)
@@ -217,7 +1180,39 @@ func doSnapshot(t *testing.T, chain *chains.Paths, params SnapshotParams) mocks.
 	service, err := NewSnapshotService(edb, idx, recovery)
 	require.NoError(t, err)
 
-	err = service.CreateSnapshot(params)
+	_, err = service.CreateSnapshot(context.Background(), params)
+	require.NoError(t, err)
+	return idx.IndexerData
+}
+
+func doDeltaSnapshot(t *testing.T, chain *chains.Paths, params DeltaParams) mocks.IndexerData {
+	chainDataPath, ancientDataPath := chain.ChainData, chain.Ancient
+	config := testConfig(chainDataPath, ancientDataPath)
+	edb, err := NewEthDB(config.Eth)
+	require.NoError(t, err)
+	defer edb.Close()
+
+	idx := mocks.NewIndexer(t)
+	service, err := NewSnapshotService(edb, idx, "")
+	require.NoError(t, err)
+
+	err = service.CreateDeltaSnapshot(context.Background(), params)
+	require.NoError(t, err)
+	return idx.IndexerData
+}
+
+func doStateDiffs(t *testing.T, chain *chains.Paths, params StateDiffRangeParams) mocks.IndexerData {
+	chainDataPath, ancientDataPath := chain.ChainData, chain.Ancient
+	config := testConfig(chainDataPath, ancientDataPath)
+	edb, err := NewEthDB(config.Eth)
+	require.NoError(t, err)
+	defer edb.Close()
+
+	idx := mocks.NewIndexer(t)
+	service, err := NewSnapshotService(edb, idx, "")
+	require.NoError(t, err)
+
+	err = service.CreateStateDiffs(context.Background(), params)
 	require.NoError(t, err)
 	return idx.IndexerData
 }
@@ -235,7 +1230,7 @@ func doSnapshotWithRecovery(
 	defer edb.Close()
 
 	indexer := &mocks.InterruptingIndexer{
-		Indexer:        mocks.NewIndexer(t),
+		TxIndexer:      mocks.NewTxIndexer(t),
 		InterruptAfter: failAfter,
 	}
 	t.Logf("Will interrupt after %d state nodes", failAfter)
@@ -243,23 +1238,30 @@ func doSnapshotWithRecovery(
 	recoveryFile := filepath.Join(t.TempDir(), "recover.csv")
 	service, err := NewSnapshotService(edb, indexer, recoveryFile)
 	require.NoError(t, err)
-	err = service.CreateSnapshot(params)
+	_, err = service.CreateSnapshot(context.Background(), params)
 	require.Error(t, err)
 
 	require.FileExists(t, recoveryFile)
 	// We should only have processed nodes up to the break, plus an extra node per worker
 	require.LessOrEqual(t, len(indexer.StateNodes), int(indexer.InterruptAfter+params.Workers))
 
-	// use the nested mock indexer, to continue where it left off
-	recoveryIndexer := indexer.Indexer
+	// use the nested mock indexer, to continue from what was committed
+	recoveryIndexer := indexer.TxIndexer
 	service, err = NewSnapshotService(edb, recoveryIndexer, recoveryFile)
 	require.NoError(t, err)
-	err = service.CreateSnapshot(params)
+	_, err = service.CreateSnapshot(context.Background(), params)
 	require.NoError(t, err)
+	require.NoFileExists(t, recoveryFile)
 
 	return recoveryIndexer.IndexerData
 }
 
+func encodeAccount(t *testing.T, account *types.StateAccount) string {
+	enc, err := rlp.EncodeToBytes(account)
+	require.NoError(t, err)
+	return string(enc)
+}
+
 func sliceToSet[T comparable](slice []T) map[T]struct{} {
 	set := make(map[T]struct{})
 	for _, v := range slice {
@@ -0,0 +1,126 @@
+// Copyright © 2024 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// RecoveryStatus describes how far an interrupted snapshot got, from its recovery checkpoint.
+type RecoveryStatus struct {
+	// Version is the version of the recovery file format
+	Version int
+	// The identity of the snapshot the checkpoint was saved for. Version 1 files record none.
+	StateRoot        common.Hash
+	BlockHash        common.Hash
+	WatchedAddresses []common.Address
+	Workers          uint
+	Output           string
+
+	// Ranges holds the unfinished ranges, those of the state trie first.
+	Ranges []RangeStatus
+	// Percent estimates the completion of the state trie, as the part of its key space outside the
+	// unfinished state ranges. Divided storage tries are not included.
+	Percent float64
+	// Mismatches describes how the checkpoint differs from the snapshot it was checked against, so
+	// that it would not be resumed without overriding the mismatch policy.
+	Mismatches []string
+}
+
+// RangeStatus describes an unfinished range in a recovery checkpoint. Paths are in nibbles.
+type RangeStatus struct {
+	// Start is the start of the range, if the file records it
+	Start []byte
+	// Position is the last node the range's iterator is known to have finished
+	Position []byte
+	// End is the end of the range, or nil for the end of the trie
+	End []byte
+	// Account is the leaf key of the account whose storage trie the range covers, or zero for a
+	// range of the state trie
+	Account common.Hash
+	// Percent estimates the completion of the range by key space, or is -1 if the file does not
+	// record its start
+	Percent float64
+}
+
+// RecoveryStatus reads the recovery checkpoint saved under name and checks it against the snapshot
+// of header with params. If header is nil, the state root and block hash are not checked. It
+// returns nil if there is no checkpoint.
+func (s *Service) RecoveryStatus(
+	ctx context.Context, name string, header *types.Header, params SnapshotParams,
+) (*RecoveryStatus, error) {
+	rows, err := s.recovery.Load(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load recovery checkpoint %s: %w", name, err)
+	}
+	if rows == nil {
+		return nil, nil
+	}
+	saved, rows, err := parseRecoveryIdentity(rows)
+	if err != nil {
+		return nil, fmt.Errorf("invalid recovery file %s: %w", name, err)
+	}
+	ranges, err := parseRanges(saved.version, rows)
+	if err != nil {
+		return nil, fmt.Errorf("invalid recovery file %s: %w", name, err)
+	}
+
+	status := &RecoveryStatus{
+		Version:          saved.version,
+		StateRoot:        saved.stateRoot,
+		BlockHash:        saved.blockHash,
+		WatchedAddresses: saved.watched,
+		Workers:          saved.workers,
+		Output:           saved.output,
+	}
+	var id recoveryIdentity
+	if header != nil {
+		id = s.recoveryIdentity(header, params)
+	} else {
+		// without a header, only what is configured can be checked
+		id = s.recoveryIdentity(&types.Header{}, params)
+		id.stateRoot, id.blockHash = saved.stateRoot, saved.blockHash
+	}
+	status.Mismatches = id.mismatches(saved)
+
+	remaining := 0.0
+	for _, r := range ranges {
+		rs := RangeStatus{
+			Position: r.path,
+			End:      r.endPath,
+			Account:  common.BytesToHash(r.leafKey),
+			Percent:  -1,
+		}
+		end, position := pathFraction(r.endPath, 1), pathFraction(r.path, 0)
+		if r.hasStart {
+			rs.Start = r.start
+			if start := pathFraction(r.start, 0); end > start {
+				rs.Percent = math.Min(math.Max(position-start, 0)/(end-start)*100, 100)
+			}
+		}
+		if r.leafKey == nil {
+			remaining += math.Max(end-position, 0)
+		}
+		status.Ranges = append(status.Ranges, rs)
+	}
+	status.Percent = math.Max(100-remaining*100, 0)
+	return status, nil
+}
@@ -0,0 +1,82 @@
+package snapshot_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cerc-io/ipld-eth-state-snapshot/internal/mocks"
+	. "github.com/cerc-io/ipld-eth-state-snapshot/pkg/snapshot"
+	fixture "github.com/cerc-io/ipld-eth-state-snapshot/test"
+)
+
+func TestRecoveryStatus(t *testing.T) {
+	edb := openEthDB(t, fixture.ChainA)
+	header := rawdb.ReadHeader(edb, rawdb.ReadCanonicalHash(edb, 1), 1)
+	recoveryFile := filepath.Join(t.TempDir(), "recover.csv")
+	params := SnapshotParams{Height: 1, Workers: 4}
+
+	service, err := NewSnapshotService(edb, nil, recoveryFile)
+	require.NoError(t, err)
+	status, err := service.RecoveryStatus(context.Background(), recoveryFile, header, params)
+	require.NoError(t, err)
+	require.Nil(t, status)
+
+	idx := &mocks.InterruptingIndexer{
+		TxIndexer:      mocks.NewTxIndexer(t),
+		InterruptAfter: uint(len(fixture.ChainA_Block1_StateNodeLeafKeys) / 2),
+	}
+	service, err = NewSnapshotService(edb, idx, recoveryFile)
+	require.NoError(t, err)
+	service.SetBatchSize(1, 0)
+	// a short queue keeps the iterators from running ahead of the writer, so that their progress
+	// is saved before the interrupt
+	service.SetWriters(1, 1)
+	service.SetCommitInterval(1)
+	_, err = service.CreateSnapshot(context.Background(), params)
+	require.ErrorContains(t, err, "mock interrupt")
+
+	status, err = service.RecoveryStatus(context.Background(), recoveryFile, header, params)
+	require.NoError(t, err)
+	require.NotNil(t, status)
+	require.Equal(t, 3, status.Version)
+	require.Equal(t, header.Root, status.StateRoot)
+	require.Equal(t, header.Hash(), status.BlockHash)
+	require.Equal(t, uint(4), status.Workers)
+	require.Empty(t, status.Mismatches)
+	require.NotEmpty(t, status.Ranges)
+	require.Greater(t, status.Percent, 0.0)
+	require.Less(t, status.Percent, 100.0)
+	for _, r := range status.Ranges {
+		require.Equal(t, common.Hash{}, r.Account)
+		require.GreaterOrEqual(t, r.Percent, 0.0)
+		require.LessOrEqual(t, r.Percent, 100.0)
+	}
+
+	// without a header, only the configured parameters are checked
+	watched := params
+	watched.WatchedAddresses = []common.Address{common.HexToAddress("0x01")}
+	status, err = service.RecoveryStatus(context.Background(), recoveryFile, nil, watched)
+	require.NoError(t, err)
+	require.Len(t, status.Mismatches, 1)
+	other := rawdb.ReadHeader(edb, rawdb.ReadCanonicalHash(edb, 2), 2)
+	status, err = service.RecoveryStatus(context.Background(), recoveryFile, other, params)
+	require.NoError(t, err)
+	require.NotEmpty(t, status.Mismatches)
+	require.Contains(t, status.Mismatches[0], "block hash")
+
+	// a file without identity or range starts can still be read
+	require.NoError(t, os.WriteFile(recoveryFile, []byte(",00\n0000,\n"), 0644))
+	status, err = service.RecoveryStatus(context.Background(), recoveryFile, header, params)
+	require.NoError(t, err)
+	require.Equal(t, 1, status.Version)
+	require.Len(t, status.Mismatches, 1)
+	require.Len(t, status.Ranges, 2)
+	require.Equal(t, -1.0, status.Ranges[0].Percent)
+	require.Equal(t, 0.0, status.Percent)
+}
@@ -0,0 +1,231 @@
+// Copyright © 2024 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cerc-io/plugeth-statediff/indexer"
+	"github.com/jmoiron/sqlx"
+	log "github.com/sirupsen/logrus"
+)
+
+// RecoveryStore holds the recovery checkpoints of interrupted snapshots, each under a name. A
+// checkpoint is saved as the rows of the recovery file format: the snapshot's identity followed by
+// the positions of its iterators.
+type RecoveryStore interface {
+	// Load returns the rows saved under name, or nil if there are none.
+	Load(ctx context.Context, name string) ([][]string, error)
+	// Save replaces the rows saved under name. They must survive a crash once it returns.
+	Save(ctx context.Context, name string, rows [][]string) error
+	// Remove deletes the rows saved under name, if any.
+	Remove(ctx context.Context, name string) error
+}
+
+// SetRecoveryStore sets where recovery checkpoints are saved, under the name of the recovery file.
+// The default is a FileRecoveryStore.
+func (s *Service) SetRecoveryStore(store RecoveryStore) {
+	s.recovery = store
+}
+
+// FileRecoveryStore saves each checkpoint as a CSV file, at the path given by its name.
+type FileRecoveryStore struct{}
+
+func NewFileRecoveryStore() *FileRecoveryStore {
+	return &FileRecoveryStore{}
+}
+
+func (*FileRecoveryStore) Load(_ context.Context, path string) ([][]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+	return readRecoveryRows(file)
+}
+
+// Save replaces the file atomically, so a crash leaves either the previous checkpoint or this one.
+func (*FileRecoveryStore) Save(_ context.Context, path string, rows [][]string) error {
+	dir := filepath.Dir(path)
+	file, err := os.CreateTemp(dir, filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	out := csv.NewWriter(file)
+	if err = out.WriteAll(rows); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(file.Name(), path); err != nil {
+		return err
+	}
+	// sync the directory so that the rename itself survives a crash, where the filesystem allows
+	if err = syncFile(dir); err != nil {
+		log.WithError(err).WithField("dir", dir).Warn("Failed to sync recovery file directory")
+	}
+	return nil
+}
+
+func (*FileRecoveryStore) Remove(_ context.Context, path string) error {
+	err := os.Remove(path)
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	return err
+}
+
+// TxRecoveryStore is a RecoveryStore which can save a checkpoint in the indexer transaction of
+// each writer of a snapshot, so that it is committed with the data it covers. It keeps the latest
+// checkpoint committed by each writer, and loads the earliest of them, which covers what every
+// writer has committed.
+type TxRecoveryStore interface {
+	RecoveryStore
+	// Reset replaces the rows saved under name with the given rows, as the checkpoint of each of
+	// the given number of writers.
+	Reset(ctx context.Context, name string, writers int, rows [][]string) error
+	// SaveTx saves the rows of a writer's checkpoint under name in the writer's batch. seq orders
+	// the checkpoints of a snapshot, from 1.
+	SaveTx(tx indexer.Batch, name string, writer int, seq uint64, rows [][]string) error
+}
+
+// PgRecoveryStore saves checkpoints in the eth_meta.snapshot_recovery table, which is created if
+// it does not exist, alongside the output they describe, so that they outlive the machine the
+// snapshot runs on. Each writer of a snapshot saves its checkpoints in its own transaction, through
+// a PgIndexer, so they are committed with the data.
+//
+// When a snapshot stops, some writers may have committed later checkpoints than others. It is
+// resumed from the earliest, and the data the others committed since then is written again.
+type PgRecoveryStore struct {
+	db *sqlx.DB
+}
+
+var _ TxRecoveryStore = (*PgRecoveryStore)(nil)
+
+const (
+	pgCreateRecoveryStm = `CREATE TABLE IF NOT EXISTS eth_meta.snapshot_recovery (
+		name TEXT NOT NULL,
+		writer INTEGER NOT NULL,
+		seq BIGINT NOT NULL,
+		checkpoint TEXT NOT NULL,
+		updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+		PRIMARY KEY (name, writer)
+	)`
+	pgLoadRecoveryStm = `SELECT checkpoint FROM eth_meta.snapshot_recovery WHERE name = $1
+		ORDER BY seq, writer LIMIT 1`
+	pgResetRecoveryStm = `INSERT INTO eth_meta.snapshot_recovery (name, writer, seq, checkpoint)
+		SELECT $1, writer, 0, $3 FROM generate_series(0, $2::INTEGER - 1) AS writer`
+	pgSaveRecoveryStm = `INSERT INTO eth_meta.snapshot_recovery (name, writer, seq, checkpoint) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (name, writer) DO UPDATE SET seq = EXCLUDED.seq, checkpoint = EXCLUDED.checkpoint, updated_at = now()`
+	pgRemoveRecoveryStm = `DELETE FROM eth_meta.snapshot_recovery WHERE name = $1`
+)
+
+// NewPgRecoveryStore uses the database the snapshot is written to, which is not closed with it.
+func NewPgRecoveryStore(ctx context.Context, db *sqlx.DB) (*PgRecoveryStore, error) {
+	if _, err := db.ExecContext(ctx, pgCreateRecoveryStm); err != nil {
+		return nil, fmt.Errorf("failed to create recovery table: %w", err)
+	}
+	return &PgRecoveryStore{db: db}, nil
+}
+
+func (r *PgRecoveryStore) Load(ctx context.Context, name string) ([][]string, error) {
+	var checkpoint string
+	err := r.db.GetContext(ctx, &checkpoint, pgLoadRecoveryStm, name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return readRecoveryRows(strings.NewReader(checkpoint))
+}
+
+// Save replaces the rows saved under name with a single checkpoint.
+func (r *PgRecoveryStore) Save(ctx context.Context, name string, rows [][]string) error {
+	return r.Reset(ctx, name, 1, rows)
+}
+
+func (r *PgRecoveryStore) Reset(ctx context.Context, name string, writers int, rows [][]string) error {
+	checkpoint, err := writeRecoveryRows(rows)
+	if err != nil {
+		return err
+	}
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err = tx.ExecContext(ctx, pgRemoveRecoveryStm, name); err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, pgResetRecoveryStm, name, writers, checkpoint); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SaveTx saves the checkpoint in a batch of a PgIndexer.
+func (r *PgRecoveryStore) SaveTx(tx indexer.Batch, name string, writer int, seq uint64, rows [][]string) error {
+	b, ok := tx.(*pgBatch)
+	if !ok {
+		return fmt.Errorf("postgres recovery store: batch is expected to be of type %T, got %T", &pgBatch{}, tx)
+	}
+	checkpoint, err := writeRecoveryRows(rows)
+	if err != nil {
+		return err
+	}
+	_, err = b.tx.Exec(context.Background(), pgSaveRecoveryStm, name, writer, seq, checkpoint)
+	return err
+}
+
+func (r *PgRecoveryStore) Remove(ctx context.Context, name string) error {
+	_, err := r.db.ExecContext(ctx, pgRemoveRecoveryStm, name)
+	return err
+}
+
+// readRecoveryRows reads the rows of a checkpoint in the recovery file format.
+func readRecoveryRows(r io.Reader) ([][]string, error) {
+	in := csv.NewReader(r)
+	// rows have varying numbers of fields
+	in.FieldsPerRecord = -1
+	return in.ReadAll()
+}
+
+// writeRecoveryRows returns the rows of a checkpoint in the recovery file format.
+func writeRecoveryRows(rows [][]string) (string, error) {
+	var buf bytes.Buffer
+	if err := csv.NewWriter(&buf).WriteAll(rows); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
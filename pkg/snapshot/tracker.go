@@ -0,0 +1,581 @@
+// Copyright © 2024 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	iter "github.com/cerc-io/eth-iterator-utils"
+	"github.com/cerc-io/plugeth-statediff/indexer"
+	sdtypes "github.com/cerc-io/plugeth-statediff/types"
+	"github.com/ethereum/go-ethereum/trie"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/cerc-io/ipld-eth-state-snapshot/pkg/prom"
+)
+
+// iteratorTracker tracks the subtrie iterators of a snapshot, so that their positions can be saved
+// to the recovery store and restored to resume an interrupted snapshot.
+//
+// Unlike the tracker from eth-iterator-utils, positions can be saved while the iterators are
+// running. An iterator's position is the node it last moved to, and every node before it has been
+// fully processed, so a checkpoint covers all the output emitted before it was taken. The node at
+// the position may be written again on resume.
+//
+// Iterators over ranges of a storage trie do not move their position as they are advanced, since
+// their storage nodes are emitted in chunks. It is set as each chunk is emitted instead, to the key
+// after the chunk's last leaf, so no leaf of a storage range is written again on resume.
+//
+// A running iterator can be asked to split the rest of its range, for an idle worker to take over.
+// Its end is moved to the midpoint between its position and its end, and a new iterator is tracked
+// over the upper half, so both are saved to the recovery file.
+type iteratorTracker struct {
+	// checkpoints are saved to store under the name of the recovery file
+	ctx          context.Context
+	store        RecoveryStore
+	recoveryFile string
+	// identity is written at the start of the recovery file
+	identity recoveryIdentity
+	// writers is the number of writers which each commit their part of a checkpoint, if the store
+	// is a TxRecoveryStore
+	writers int
+	// onDone is called when an iterator is exhausted
+	onDone func()
+	// onStart and onFinish, if set, are called when an iterator is first advanced and once it is
+	// done, after onDone
+	onStart, onFinish func(*trackedIterator)
+	// onSplit is called with the iterator over a range split off from a running one
+	onSplit func(*trackedIterator)
+
+	// startMtx serializes the first call to each iterator's Next. The iterators share a trie, whose
+	// root is hashed in place when an iterator is first advanced.
+	startMtx sync.Mutex
+
+	mtx   sync.Mutex
+	iters map[*trackedIterator]struct{}
+	// all holds every tracked iterator, including finished ones
+	all []*trackedIterator
+	// splitting counts the requested splits which have not yet been made
+	splitting int
+}
+
+type trackedIterator struct {
+	trie.NodeIterator
+	tracker *iteratorTracker
+	// bounded is the wrapped iterator, whose end is moved when its range is split
+	bounded *iter.PrefixBoundIterator
+	metrics prom.RangeIterator
+	// construct creates iterators over the same trie, for the ranges split off
+	construct iter.IteratorConstructor
+	index     int
+	startPath []byte
+	// origin is the start of the range when it was first tracked, which is kept across resumes
+	origin []byte
+	// owner is the account whose storage trie is iterated, or nil for the state trie
+	owner *sdtypes.AccountWrapper
+	// splitRequested is set when the rest of the range should be split at the next move
+	splitRequested atomic.Bool
+	// endPath, path, started, done and unsplittable are guarded by the tracker's mutex
+	endPath                     []byte
+	path                        []byte
+	started, done, unsplittable bool
+}
+
+func newIteratorTracker(
+	ctx context.Context, store RecoveryStore, recoveryFile string, identity recoveryIdentity,
+) *iteratorTracker {
+	return &iteratorTracker{
+		ctx:          ctx,
+		store:        store,
+		recoveryFile: recoveryFile,
+		identity:     identity,
+		iters:        make(map[*trackedIterator]struct{}),
+	}
+}
+
+// storageOpener opens the storage trie of the account with the given leaf key, returning the
+// account as written with the given CID.
+type storageOpener func(leafKey []byte, cid string) (*sdtypes.AccountWrapper, iter.IteratorConstructor, error)
+
+// Restore creates iterators from the positions in the recovery checkpoint, if there is one. Ranges of
+// storage tries are opened with openStorage. The file's identity is not checked here, but before
+// the snapshot is started. The file is left in place until it is replaced by the next checkpoint.
+//
+// The file may have been saved with fewer workers than the tracker's identity has, in which case
+// the largest state ranges are split until there is one for each worker. With fewer workers, the
+// extra ranges wait for a worker to be free.
+func (tr *iteratorTracker) Restore(makeIterator iter.IteratorConstructor, openStorage storageOpener) (
+	[]*trackedIterator, error,
+) {
+	rows, err := tr.store.Load(tr.ctx, tr.recoveryFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load recovery checkpoint %s: %w", tr.recoveryFile, err)
+	}
+	if rows == nil {
+		return nil, nil
+	}
+	log.WithField("file", tr.recoveryFile).Info("Restoring iterator positions")
+	saved, rows, err := parseRecoveryIdentity(rows)
+	if err != nil {
+		return nil, fmt.Errorf("invalid recovery file %s: %w", tr.recoveryFile, err)
+	}
+
+	ranges, err := parseRanges(saved.version, rows)
+	if err != nil {
+		return nil, fmt.Errorf("invalid recovery file %s: %w", tr.recoveryFile, err)
+	}
+	if saved.workers != 0 && saved.workers != tr.identity.workers {
+		log.WithField("saved", saved.workers).WithField("workers", tr.identity.workers).
+			Info("Resuming with a different number of workers, repartitioning ranges")
+	}
+	ranges = partitionRanges(ranges, int(tr.identity.workers))
+
+	var tracked []*trackedIterator
+	for _, r := range ranges {
+		construct, owner := makeIterator, (*sdtypes.AccountWrapper)(nil)
+		if r.leafKey != nil {
+			if owner, construct, err = openStorage(r.leafKey, r.cid); err != nil {
+				return nil, err
+			}
+		}
+		path := r.path
+		if len(path)&1 == 1 {
+			path = rewindPath(path)
+		}
+		it, err := construct(iter.HexToKeyBytes(path))
+		if err != nil {
+			return nil, err
+		}
+		// the iterator has not moved, so is not at the saved position until it does
+		ret := tr.newTracked(iter.NewPrefixBoundIterator(it, r.endPath), construct, owner, r.path, r.path)
+		if r.hasStart {
+			ret.origin = r.start
+		}
+		tr.mtx.Lock()
+		tr.register(ret)
+		tr.mtx.Unlock()
+		tracked = append(tracked, ret)
+	}
+	return tracked, nil
+}
+
+// partitionRanges splits the largest of the state ranges in two, as a running iterator's range is
+// split, until there are at least n or none can be split. Storage ranges are left as they are.
+func partitionRanges(ranges []savedRange, n int) []savedRange {
+	var state []int
+	for i, r := range ranges {
+		if r.leafKey == nil {
+			state = append(state, i)
+		}
+	}
+	unsplittable := make(map[int]bool)
+	for len(state) < n {
+		largest, most := -1, 0.0
+		for _, i := range state {
+			r := ranges[i]
+			if left := pathFraction(r.endPath, 1) - pathFraction(r.path, 0); !unsplittable[i] && left > most {
+				largest, most = i, left
+			}
+		}
+		if largest < 0 {
+			break
+		}
+		r := ranges[largest]
+		mid := midPath(r.path, r.endPath)
+		if mid == nil {
+			unsplittable[largest] = true
+			continue
+		}
+		ranges[largest].endPath = mid
+		ranges = append(ranges, savedRange{
+			path: append(bytes.Clone(mid), 0), endPath: r.endPath, start: mid, hasStart: true,
+		})
+		state = append(state, len(ranges)-1)
+	}
+	return ranges
+}
+
+// Tracked wraps the subtrie iterators over the state trie so that their positions are tracked.
+// Ranges split off from them are iterated with construct.
+func (tr *iteratorTracker) Tracked(iters []trie.NodeIterator, construct iter.IteratorConstructor) []*trackedIterator {
+	return tr.trackSubtries(iters, construct, nil)
+}
+
+// TrackedStorage wraps the subtrie iterators over an account's storage trie so that their
+// positions can be tracked. Ranges split off from them are iterated with construct. The ranges are
+// tracked together, since a checkpoint holding only some of them would lose the others on resume.
+func (tr *iteratorTracker) TrackedStorage(
+	iters []trie.NodeIterator, construct iter.IteratorConstructor, owner *sdtypes.AccountWrapper,
+) []*trackedIterator {
+	return tr.trackSubtries(iters, construct, owner)
+}
+
+// trackSubtries tracks the iterators returned by SubtrieIterators, in order. Each range starts at
+// the end of the one before, and the first at the start of the trie.
+func (tr *iteratorTracker) trackSubtries(
+	iters []trie.NodeIterator, construct iter.IteratorConstructor, owner *sdtypes.AccountWrapper,
+) []*trackedIterator {
+	ret := make([]*trackedIterator, len(iters))
+	var start []byte
+	for i, it := range iters {
+		path := start
+		// like the ranges split off, a range starting at an odd path begins past the node there
+		if len(path)&1 == 1 {
+			path = append(bytes.Clone(path), 0)
+		}
+		ret[i] = tr.newTracked(it, construct, owner, start, path)
+		start = ret[i].endPath
+	}
+	tr.mtx.Lock()
+	defer tr.mtx.Unlock()
+	for _, it := range ret {
+		tr.register(it)
+	}
+	return ret
+}
+
+// newTracked wraps an iterator over the range from startPath, positioned at path. An iterator
+// which has not been advanced is at the last node before its start, or at none, so its position is
+// only taken from the iterator once it has moved.
+func (tr *iteratorTracker) newTracked(
+	it trie.NodeIterator, construct iter.IteratorConstructor, owner *sdtypes.AccountWrapper,
+	startPath, path []byte,
+) *trackedIterator {
+	var endPath []byte
+	bounded, ok := it.(*iter.PrefixBoundIterator)
+	if ok {
+		_, endPath = bounded.Bounds()
+	}
+	metrics := prom.TrackIterator(it, startPath, endPath)
+	return &trackedIterator{
+		NodeIterator: metrics,
+		tracker:      tr,
+		bounded:      bounded,
+		metrics:      metrics,
+		construct:    construct,
+		startPath:    startPath,
+		origin:       startPath,
+		endPath:      endPath,
+		owner:        owner,
+		path:         bytes.Clone(path),
+		unsplittable: !ok || construct == nil,
+	}
+}
+
+// register adds an iterator to those tracked. The tracker's mutex must be held.
+func (tr *iteratorTracker) register(it *trackedIterator) {
+	it.index = len(tr.all)
+	tr.iters[it] = struct{}{}
+	tr.all = append(tr.all, it)
+}
+
+func (it *trackedIterator) Next(descend bool) bool {
+	tr := it.tracker
+	// started is only set by the iterator's own goroutine, so can be read without the lock
+	var ret bool
+	if !it.started {
+		tr.startMtx.Lock()
+		ret = it.NodeIterator.Next(descend)
+		tr.startMtx.Unlock()
+	} else {
+		ret = it.NodeIterator.Next(descend)
+	}
+
+	tr.mtx.Lock()
+	started := !it.started
+	it.started = true
+	tr.mtx.Unlock()
+	if started && tr.onStart != nil {
+		tr.onStart(it)
+	}
+
+	if it.owner == nil {
+		if ret {
+			it.setPosition(bytes.Clone(it.Path()))
+		} else {
+			it.finish()
+		}
+	}
+	if ret && it.splitRequested.Load() {
+		it.split()
+	}
+	return ret
+}
+
+// RequestSplit asks the running iterator with the most of its range left to split off the rest of
+// it at its next move, returning false if no iterator can be split.
+func (tr *iteratorTracker) RequestSplit() bool {
+	tr.mtx.Lock()
+	defer tr.mtx.Unlock()
+	var busiest *trackedIterator
+	var most float64
+	for it := range tr.iters {
+		if !it.started || it.unsplittable || it.splitRequested.Load() {
+			continue
+		}
+		if left := pathFraction(it.endPath, 1) - pathFraction(it.path, 0); left > most {
+			busiest, most = it, left
+		}
+	}
+	if busiest == nil {
+		return false
+	}
+	busiest.splitRequested.Store(true)
+	tr.splitting++
+	return true
+}
+
+// PendingSplits returns the number of requested splits which have not yet been made.
+func (tr *iteratorTracker) PendingSplits() int {
+	tr.mtx.Lock()
+	defer tr.mtx.Unlock()
+	return tr.splitting
+}
+
+// split moves the iterator's end to the midpoint of the rest of its range, and passes an iterator
+// over the upper half to onSplit. It is called from the iterator's own goroutine, between moves.
+func (it *trackedIterator) split() {
+	tr := it.tracker
+	tr.mtx.Lock()
+	it.splitRequested.Store(false)
+	tr.splitting--
+	endPath := it.endPath
+	mid := midPath(it.Path(), endPath)
+	if mid == nil {
+		it.unsplittable = true
+		tr.mtx.Unlock()
+		return
+	}
+	tr.mtx.Unlock()
+
+	// creating an iterator hashes the trie, as when one is first advanced
+	tr.startMtx.Lock()
+	start := append(bytes.Clone(mid), 0)
+	sub, err := it.construct(iter.HexToKeyBytes(start))
+	tr.startMtx.Unlock()
+	if err != nil {
+		log.WithError(err).Warn("Failed to split iterator")
+		tr.mtx.Lock()
+		it.unsplittable = true
+		tr.mtx.Unlock()
+		return
+	}
+	ret := tr.newTracked(iter.NewPrefixBoundIterator(sub, endPath), it.construct, it.owner, mid, start)
+	// the new range must be tracked as soon as it is cut from this one, to be in every checkpoint
+	tr.mtx.Lock()
+	it.endPath = mid
+	it.bounded.EndPath = mid
+	tr.register(ret)
+	tr.mtx.Unlock()
+	it.metrics.SetEnd(mid)
+
+	log.WithField("from", fmt.Sprintf("%x", mid)).WithField("to", fmt.Sprintf("%x", endPath)).
+		Debug("Split iterator range")
+	if tr.onSplit != nil {
+		tr.onSplit(ret)
+	}
+}
+
+// setPosition records that every node before path has been emitted.
+func (it *trackedIterator) setPosition(path []byte) {
+	it.tracker.mtx.Lock()
+	defer it.tracker.mtx.Unlock()
+	it.path = path
+}
+
+// finish records that every node in the iterator's range has been emitted.
+func (it *trackedIterator) finish() {
+	tr := it.tracker
+	tr.mtx.Lock()
+	it.done = true
+	delete(tr.iters, it)
+	if it.splitRequested.Swap(false) {
+		tr.splitting--
+	}
+	tr.mtx.Unlock()
+
+	if tr.onDone != nil {
+		tr.onDone()
+	}
+	if tr.onFinish != nil {
+		tr.onFinish(it)
+	}
+}
+
+// Percent estimates the completion of the state trie's iterators, as the part of their combined
+// key space which has been covered. Storage ranges are not included, since they are only added
+// once their trie is reached.
+func (tr *iteratorTracker) Percent() float64 {
+	tr.mtx.Lock()
+	defer tr.mtx.Unlock()
+	var covered, total float64
+	for _, it := range tr.all {
+		if it.owner != nil {
+			continue
+		}
+		start, end := pathFraction(it.startPath, 0), pathFraction(it.endPath, 1)
+		total += end - start
+		if it.done {
+			covered += end - start
+		} else if it.started {
+			covered += math.Max(pathFraction(it.path, 0)-start, 0)
+		}
+	}
+	if total <= 0 {
+		return 0
+	}
+	return math.Min(covered/total*100, 100)
+}
+
+// checkpoint holds the positions of the unfinished iterators at a point in time, as rows of the
+// recovery file.
+type checkpoint [][]string
+
+// Checkpoint returns the current positions of the unfinished iterators. Every node before them has
+// been emitted to the sinks.
+func (tr *iteratorTracker) Checkpoint() checkpoint {
+	tr.mtx.Lock()
+	defer tr.mtx.Unlock()
+	rows := make(checkpoint, 0, len(tr.iters))
+	for it := range tr.iters {
+		row := []string{fmt.Sprintf("%x", it.path), fmt.Sprintf("%x", it.endPath), fmt.Sprintf("%x", it.origin)}
+		if it.owner != nil {
+			row = append(row, fmt.Sprintf("%x", it.owner.LeafKey), it.owner.CID)
+		}
+		rows = append(rows, row)
+	}
+	// state ranges first, then the ranges of each storage trie
+	sort.Slice(rows, func(i, j int) bool {
+		if len(rows[i]) != len(rows[j]) {
+			return len(rows[i]) < len(rows[j])
+		}
+		if len(rows[i]) == 5 && rows[i][3] != rows[j][3] {
+			return rows[i][3] < rows[j][3]
+		}
+		return rows[i][1] < rows[j][1]
+	})
+	return rows
+}
+
+// Save saves a checkpoint to the recovery store after the tracker's identity, or removes the saved
+// one if all iterators were finished.
+func (tr *iteratorTracker) Save(rows checkpoint) error {
+	if len(rows) == 0 {
+		return tr.store.Remove(tr.ctx, tr.recoveryFile)
+	}
+	return tr.store.Save(tr.ctx, tr.recoveryFile, append(tr.identity.rows(), rows...))
+}
+
+// Begin saves the positions the iterators start from, so that a snapshot which fails before its
+// first checkpoint is resumed from them. If the store is a TxRecoveryStore, they are saved as the
+// checkpoint of every writer, replacing those of a previous run which may have had a different
+// number of writers. It must be called before any checkpoint is saved.
+func (tr *iteratorTracker) Begin() error {
+	rows := append(tr.identity.rows(), tr.Checkpoint()...)
+	if store, ok := tr.store.(TxRecoveryStore); ok {
+		return store.Reset(tr.ctx, tr.recoveryFile, tr.writers, rows)
+	}
+	return tr.store.Save(tr.ctx, tr.recoveryFile, rows)
+}
+
+// SaveTx saves a checkpoint after the tracker's identity in a writer's batch, so that it is
+// committed with what the writer has written up to it. The store must be a TxRecoveryStore.
+func (tr *iteratorTracker) SaveTx(tx indexer.Batch, writer int, seq uint64, rows checkpoint) error {
+	return tr.store.(TxRecoveryStore).SaveTx(tx, tr.recoveryFile, writer, seq, append(tr.identity.rows(), rows...))
+}
+
+// rewindPath returns a path from which an iterator will revisit the node at an odd-length path,
+// since iterators can only be started from whole key bytes. (From eth-iterator-utils.)
+func rewindPath(path []byte) []byte {
+	if len(path) == 0 || path[len(path)-1] == 0x10 {
+		return path
+	}
+	if path[len(path)-1] == 0 {
+		return path[:len(path)-1]
+	}
+	padded := make([]byte, 64)
+	i := copy(padded, path)
+	padded[len(path)-1]--
+	for ; i < len(padded); i++ {
+		padded[i] = 0xf
+	}
+	return padded
+}
+
+// splitDepth is the number of nibbles at which ranges are split, so a range can be split until it
+// covers 1/16^splitDepth of the key space.
+const splitDepth = 8
+
+// midPath returns the path halfway between path and endPath, or nil if they are too close. A nil
+// endPath is the end of the trie. Like the bounds of subtrie iterators, the returned path has an odd
+// length, so that it can end one range and, padded with a zero nibble, start the next without the
+// two sharing a node.
+func midPath(path, endPath []byte) []byte {
+	from, to := pathValue(path), uint64(1)<<(4*splitDepth)
+	if endPath != nil {
+		to = pathValue(endPath)
+	}
+	if to <= from+1 {
+		return nil
+	}
+	mid := make([]byte, splitDepth)
+	for i, v := splitDepth-1, (from+to)/2; i >= 0; i, v = i-1, v>>4 {
+		mid[i] = byte(v & 0xf)
+	}
+	for len(mid) > 1 && mid[len(mid)-1] == 0 {
+		mid = mid[:len(mid)-1]
+	}
+	if len(mid)&1 == 0 {
+		mid = append(mid, 0)
+	}
+	return mid
+}
+
+// pathValue returns the first splitDepth nibbles of a path as a number, padding it with zeros.
+func pathValue(path []byte) uint64 {
+	var v uint64
+	for i := 0; i < splitDepth; i++ {
+		v <<= 4
+		if i < len(path) && path[i] < 0x10 {
+			v |= uint64(path[i])
+		}
+	}
+	return v
+}
+
+// pathFraction returns the position of a path in the key space, from 0 to 1. A nil path is taken
+// to be at empty.
+func pathFraction(path []byte, empty float64) float64 {
+	if path == nil {
+		return empty
+	}
+	var f float64
+	scale := 1.0
+	for _, nibble := range path {
+		if nibble >= 0x10 {
+			break
+		}
+		scale /= 16
+		f += float64(nibble) * scale
+	}
+	return f
+}
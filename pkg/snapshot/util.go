@@ -2,6 +2,11 @@ package snapshot
 
 import (
 	"bytes"
+	"fmt"
+
+	"github.com/cerc-io/plugeth-statediff/indexer/ipld"
+	sdtypes "github.com/cerc-io/plugeth-statediff/types"
+	"github.com/ipfs/go-cid"
 )
 
 // Estimate the number of iterations necessary to step from start to end.
@@ -74,3 +79,61 @@ func estimateSteps(start []byte, end []byte, depth int) uint64 {
 
 	return ret
 }
+
+// cidSet records the CIDs of IPLD blocks which have already been emitted. It is not safe for
+// concurrent use.
+type cidSet map[string]struct{}
+
+// add inserts a CID, returning false if it was already present.
+func (s cidSet) add(cid string) bool {
+	if _, has := s[cid]; has {
+		return false
+	}
+	s[cid] = struct{}{}
+	return true
+}
+
+// boundedCIDSet records up to a fixed number of CIDs, forgetting the oldest once it is full. It is
+// not safe for concurrent use.
+type boundedCIDSet struct {
+	cids cidSet
+	// order holds the CIDs in the order they were added, as a ring starting at next once full
+	order []string
+	next  int
+}
+
+func newBoundedCIDSet(capacity int) *boundedCIDSet {
+	return &boundedCIDSet{
+		cids:  make(cidSet),
+		order: make([]string, 0, capacity),
+	}
+}
+
+func (s *boundedCIDSet) has(cid string) bool {
+	_, has := s.cids[cid]
+	return has
+}
+
+// add inserts a CID, evicting the oldest if the set is full.
+func (s *boundedCIDSet) add(cid string) {
+	if !s.cids.add(cid) {
+		return
+	}
+	if len(s.order) < cap(s.order) {
+		s.order = append(s.order, cid)
+		return
+	}
+	delete(s.cids, s.order[s.next])
+	s.order[s.next] = cid
+	s.next = (s.next + 1) % len(s.order)
+}
+
+// isCode reports whether the IPLD block holds contract code, which unlike trie nodes is stored as
+// raw binary.
+func isCode(block sdtypes.IPLD) (bool, error) {
+	c, err := cid.Decode(block.CID)
+	if err != nil {
+		return false, fmt.Errorf("invalid IPLD CID %s: %w", block.CID, err)
+	}
+	return c.Prefix().Codec == ipld.RawBinary, nil
+}
@@ -0,0 +1,206 @@
+// Copyright © 2024 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/cerc-io/plugeth-statediff/indexer/ipld"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	log "github.com/sirupsen/logrus"
+)
+
+// IPLDSource provides the IPLD blocks written by a snapshot, so that they can be verified.
+type IPLDSource interface {
+	// Get returns the content of the block with the given CID, or nil if there is no such block.
+	Get(ctx context.Context, cid string) ([]byte, error)
+}
+
+// SetVerifier enables verification of each snapshot against the blocks read back from src once it
+// has been written. A snapshot fails if its state cannot be rebuilt from them.
+func (s *Service) SetVerifier(src IPLDSource) {
+	s.verifier = src
+}
+
+// VerifyStateRoot checks that the state trie at root, along with every storage trie and contract
+// code it references, can be rebuilt from the blocks in src. It fails with the first node which is
+// missing or does not match its hash.
+func VerifyStateRoot(ctx context.Context, src IPLDSource, root common.Hash) error {
+	log.WithField("root", root).Info("Verifying state")
+	var accounts, slots uint64
+	state := trieWalker{ctx: ctx, src: src, codec: ipld.MEthStateTrie, name: "state"}
+	state.onLeaf = func(path []byte, value []byte) error {
+		accounts++
+		var account types.StateAccount
+		if err := rlp.DecodeBytes(value, &account); err != nil {
+			return fmt.Errorf("invalid account at path %x: %w", path, err)
+		}
+		key := nibblesToKey(path)
+		if account.Root != types.EmptyRootHash {
+			storage := trieWalker{
+				ctx: ctx, src: src, codec: ipld.MEthStorageTrie,
+				name: fmt.Sprintf("storage (account %x)", key),
+			}
+			storage.onLeaf = func([]byte, []byte) error {
+				slots++
+				return nil
+			}
+			if err := storage.walkHash(account.Root, nil); err != nil {
+				return err
+			}
+		}
+		if !bytes.Equal(account.CodeHash, emptyCodeHash) {
+			code, err := src.Get(ctx, ipld.Keccak256ToCid(ipld.RawBinary, account.CodeHash).String())
+			if err != nil {
+				return err
+			}
+			if code == nil {
+				return fmt.Errorf("missing code %x for account %x", account.CodeHash, key)
+			}
+			if !bytes.Equal(crypto.Keccak256(code), account.CodeHash) {
+				return fmt.Errorf("code for account %x does not match code hash %x", key, account.CodeHash)
+			}
+		}
+		return nil
+	}
+	if root != types.EmptyRootHash {
+		if err := state.walkHash(root, nil); err != nil {
+			return err
+		}
+	}
+	log.WithField("root", root).WithField("accounts", accounts).WithField("slots", slots).
+		Info("State verified")
+	return nil
+}
+
+// trieWalker traverses a trie by following node hashes through an IPLDSource.
+type trieWalker struct {
+	ctx    context.Context
+	src    IPLDSource
+	codec  uint64
+	name   string
+	onLeaf func(path []byte, value []byte) error
+}
+
+func (w *trieWalker) walkHash(hash common.Hash, path []byte) error {
+	if err := w.ctx.Err(); err != nil {
+		return err
+	}
+	cid := ipld.Keccak256ToCid(w.codec, hash.Bytes()).String()
+	node, err := w.src.Get(w.ctx, cid)
+	if err != nil {
+		return fmt.Errorf("failed to read %s node %s: %w", w.name, cid, err)
+	}
+	if node == nil {
+		return fmt.Errorf("missing %s node at path %x (CID %s)", w.name, path, cid)
+	}
+	if crypto.Keccak256Hash(node) != hash {
+		return fmt.Errorf("%s node at path %x does not match its hash %s", w.name, path, hash)
+	}
+	return w.walkNode(node, path)
+}
+
+func (w *trieWalker) walkNode(node []byte, path []byte) error {
+	elems, _, err := rlp.SplitList(node)
+	if err != nil {
+		return fmt.Errorf("invalid %s node at path %x: %w", w.name, path, err)
+	}
+	count, err := rlp.CountValues(elems)
+	if err != nil {
+		return fmt.Errorf("invalid %s node at path %x: %w", w.name, path, err)
+	}
+	switch count {
+	case 2: // leaf or extension
+		compact, rest, err := rlp.SplitString(elems)
+		if err != nil {
+			return fmt.Errorf("invalid %s node at path %x: %w", w.name, path, err)
+		}
+		nibbles, leaf := compactToNibbles(compact)
+		childPath := append(append([]byte{}, path...), nibbles...)
+		if leaf {
+			value, _, err := rlp.SplitString(rest)
+			if err != nil {
+				return fmt.Errorf("invalid %s leaf at path %x: %w", w.name, childPath, err)
+			}
+			return w.onLeaf(childPath, value)
+		}
+		return w.walkChild(rest, childPath)
+	case 17: // branch
+		for i := byte(0); i < 16; i++ {
+			_, _, rest, err := rlp.Split(elems)
+			if err != nil {
+				return fmt.Errorf("invalid %s node at path %x: %w", w.name, path, err)
+			}
+			child := elems[:len(elems)-len(rest)]
+			if err := w.walkChild(child, append(append([]byte{}, path...), i)); err != nil {
+				return err
+			}
+			elems = rest
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid %s node at path %x: %d elements", w.name, path, count)
+	}
+}
+
+// walkChild follows a reference to a child node, which is either its hash or, if it is small
+// enough, the node itself.
+func (w *trieWalker) walkChild(ref []byte, path []byte) error {
+	kind, content, _, err := rlp.Split(ref)
+	if err != nil {
+		return fmt.Errorf("invalid %s node reference at path %x: %w", w.name, path, err)
+	}
+	switch {
+	case kind == rlp.List:
+		return w.walkNode(ref, path)
+	case len(content) == 0:
+		return nil
+	case len(content) == common.HashLength:
+		return w.walkHash(common.BytesToHash(content), path)
+	default:
+		return fmt.Errorf("invalid %s node reference at path %x", w.name, path)
+	}
+}
+
+// compactToNibbles decodes a hex-prefix encoded node key, also returning whether it terminates in
+// a leaf.
+func compactToNibbles(compact []byte) ([]byte, bool) {
+	if len(compact) == 0 {
+		return nil, false
+	}
+	flags := compact[0] >> 4
+	var nibbles []byte
+	if flags&1 != 0 {
+		nibbles = append(nibbles, compact[0]&0xf)
+	}
+	for _, b := range compact[1:] {
+		nibbles = append(nibbles, b>>4, b&0xf)
+	}
+	return nibbles, flags&2 != 0
+}
+
+func nibblesToKey(nibbles []byte) []byte {
+	key := make([]byte, len(nibbles)/2)
+	for i := range key {
+		key[i] = nibbles[2*i]<<4 | nibbles[2*i+1]
+	}
+	return key
+}
@@ -0,0 +1,104 @@
+package snapshot_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/cerc-io/plugeth-statediff/indexer"
+	"github.com/cerc-io/plugeth-statediff/indexer/database/file"
+	"github.com/cerc-io/plugeth-statediff/indexer/ipld"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/require"
+
+	. "github.com/cerc-io/ipld-eth-state-snapshot/pkg/snapshot"
+	fixture "github.com/cerc-io/ipld-eth-state-snapshot/test"
+)
+
+// mapSource serves IPLD blocks from memory
+type mapSource map[string][]byte
+
+func (m mapSource) Get(_ context.Context, cid string) ([]byte, error) {
+	return m[cid], nil
+}
+
+func TestVerifyFileOutput(t *testing.T) {
+	edb := openEthDB(t, fixture.ChainA)
+	dir := t.TempDir()
+	outputDir := filepath.Join(dir, "output")
+	config := file.Config{
+		Mode:                     file.CSV,
+		OutputDir:                outputDir,
+		WatchedAddressesFilePath: filepath.Join(dir, "watched-addresses.csv"),
+	}
+	_, idx, err := indexer.NewStateDiffIndexer(context.Background(), nil, DefaultNodeInfo, config, false)
+	require.NoError(t, err)
+	defer idx.Close()
+
+	src, err := NewFileIPLDSource(outputDir)
+	require.NoError(t, err)
+	defer src.Close()
+
+	service, err := NewSnapshotService(edb, idx, filepath.Join(t.TempDir(), "recover.csv"))
+	require.NoError(t, err)
+	service.SetVerifier(src)
+	_, err = service.CreateSnapshot(context.Background(), SnapshotParams{Heights: []uint64{3, 262}, Workers: 4})
+	require.NoError(t, err)
+}
+
+func TestVerifyStateRoot(t *testing.T) {
+	var height uint64 = 262
+	data := doSnapshot(t, fixture.ChainA, SnapshotParams{Height: height, Workers: 4})
+	root := data.Headers[height].Root
+
+	blocks := func() mapSource {
+		src := make(mapSource)
+		for _, block := range data.IPLDs {
+			src[block.CID] = block.Content
+		}
+		return src
+	}
+	// find a block of each kind to tamper with
+	byCodec := make(map[uint64]string)
+	for _, block := range data.IPLDs {
+		c, err := cid.Decode(block.CID)
+		require.NoError(t, err)
+		byCodec[c.Prefix().Codec] = block.CID
+	}
+	require.Contains(t, byCodec, uint64(ipld.MEthStorageTrie))
+	require.Contains(t, byCodec, uint64(ipld.RawBinary))
+
+	require.NoError(t, VerifyStateRoot(context.Background(), blocks(), root))
+
+	t.Run("missing state root", func(t *testing.T) {
+		src := blocks()
+		delete(src, ipld.Keccak256ToCid(ipld.MEthStateTrie, root.Bytes()).String())
+		err := VerifyStateRoot(context.Background(), src, root)
+		require.ErrorContains(t, err, "missing state node at path")
+	})
+	t.Run("missing storage node", func(t *testing.T) {
+		src := blocks()
+		delete(src, byCodec[ipld.MEthStorageTrie])
+		err := VerifyStateRoot(context.Background(), src, root)
+		require.ErrorContains(t, err, "missing storage")
+	})
+	t.Run("missing code", func(t *testing.T) {
+		src := blocks()
+		delete(src, byCodec[ipld.RawBinary])
+		err := VerifyStateRoot(context.Background(), src, root)
+		require.ErrorContains(t, err, "missing code")
+	})
+	t.Run("mismatched node", func(t *testing.T) {
+		src := blocks()
+		src[byCodec[ipld.MEthStorageTrie]] = []byte{0xc0}
+		err := VerifyStateRoot(context.Background(), src, root)
+		require.ErrorContains(t, err, "does not match")
+	})
+	t.Run("wrong root", func(t *testing.T) {
+		edb := openEthDB(t, fixture.ChainA)
+		other := rawdb.ReadHeader(edb, rawdb.ReadCanonicalHash(edb, 1), 1).Root
+		err := VerifyStateRoot(context.Background(), blocks(), other)
+		require.ErrorContains(t, err, "missing state node")
+	})
+}
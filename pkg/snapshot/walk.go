@@ -0,0 +1,535 @@
+// Copyright © 2024 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/bits"
+	"sync"
+
+	iter "github.com/cerc-io/eth-iterator-utils"
+	"github.com/cerc-io/plugeth-statediff/indexer/ipld"
+	sdtypes "github.com/cerc-io/plugeth-statediff/types"
+	"github.com/cerc-io/plugeth-statediff/utils"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultStorageSplit = uint64(1_000_000)
+	// number of leaves read from the start of a storage trie to estimate its size
+	storageSampleSize = 64
+	// maximum number of storage nodes emitted at a time from a range of a divided storage trie
+	storageChunkSize = 10_000
+)
+
+// SetStorageSplit sets the estimated number of slots above which a storage trie is divided into
+// ranges that are processed in parallel. If slots is 0, storage tries are never divided. They are
+// also not divided unless the indexer is a StorageIndexer, such as a PgIndexer.
+func (s *Service) SetStorageSplit(slots uint64) {
+	s.storageSplit = slots
+}
+
+// stateWalker emits the full state at a root to the sinks, in the same form as the statediff
+// builder's snapshots. Its workers take tasks from a shared list, which starts with the subtries
+// of the state trie. A storage trie estimated to hold more slots than the split threshold is
+// divided into ranges, which are added to the list so that workers can process them in parallel
+// once they are free. Since the ranges are tracked, an interrupted storage walk can be resumed.
+// When a worker finds the list empty, the rest of the busiest worker's range is split in two and
+// the upper half added to the list.
+//
+// The account of a divided trie is emitted once, without storage, and the storage nodes of its
+// ranges are emitted in chunks to the storage sink. Storage tries are only divided if there is a
+// storage sink.
+//
+// The builder has no hooks for dividing storage tries or for saving positions while it runs, so its
+// traversal is followed here rather than wrapped. Unlike the builder, embedded storage nodes are
+// not emitted.
+type stateWalker struct {
+	service     *Service
+	root        common.Hash
+	tree        *trie.StateTrie
+	tracker     *iteratorTracker
+	watched     [][]byte
+	nodeSink    sdtypes.StateNodeSink
+	ipldSink    sdtypes.IPLDSink
+	storageSink storageSink
+	workers     uint
+	// restored holds the leaf keys of the accounts whose storage ranges were restored, which are
+	// not divided again when their leaves are revisited
+	restored map[string]bool
+
+	mtx  sync.Mutex
+	cond *sync.Cond
+	// tasks holds the iterators waiting for a worker, running counts those being processed and idle
+	// counts the workers waiting for a task
+	tasks         []*trackedIterator
+	running, idle int
+}
+
+// storageSink receives storage nodes of the account with the given leaf key, apart from the
+// account's state node.
+type storageSink func(leafKey []byte, nodes []sdtypes.StorageLeafNode) error
+
+// walkState emits the state at root using the given number of workers, resuming from the tracker's
+// recovery file if it exists. If storageSink is nil, storage tries are not divided.
+func (s *Service) walkState(
+	ctx context.Context, root common.Hash, watchedAddresses []common.Address, workers uint,
+	tracker *iteratorTracker, nodeSink sdtypes.StateNodeSink, ipldSink sdtypes.IPLDSink,
+	storageSink storageSink,
+) error {
+	tree, err := trie.NewStateTrie(trie.StateTrieID(root), s.stateDB.TrieDB())
+	if err != nil {
+		return fmt.Errorf("error opening state trie: %w", err)
+	}
+	if workers == 0 {
+		workers = 1
+	}
+	w := &stateWalker{
+		service:     s,
+		root:        root,
+		tree:        tree,
+		tracker:     tracker,
+		nodeSink:    nodeSink,
+		ipldSink:    ipldSink,
+		storageSink: storageSink,
+		workers:     workers,
+		restored:    make(map[string]bool),
+	}
+	w.cond = sync.NewCond(&w.mtx)
+	tracker.onSplit = func(it *trackedIterator) { w.add(it) }
+	for _, addr := range watchedAddresses {
+		w.watched = append(w.watched, utils.KeybytesToHex(crypto.Keccak256(addr[:])))
+	}
+
+	w.tasks, err = tracker.Restore(tree.NodeIterator, w.openStorage)
+	if err != nil {
+		return fmt.Errorf("error restoring iterators: %w", err)
+	}
+	if len(w.tasks) == 0 {
+		iters, err := iter.SubtrieIterators(tree.NodeIterator, workers)
+		if err != nil {
+			return fmt.Errorf("error creating subtrie iterators for trie: %w", err)
+		}
+		w.tasks = tracker.Tracked(iters, tree.NodeIterator)
+	}
+	if err = tracker.Begin(); err != nil {
+		return fmt.Errorf("failed to save starting checkpoint: %w", err)
+	}
+	return w.run(ctx)
+}
+
+// run processes tasks on each worker until none are left, returning the first error.
+func (w *stateWalker) run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	for i := uint(0); i < w.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := w.work(ctx); err != nil {
+				once.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		}()
+	}
+	wg.Wait()
+	if firstErr == nil {
+		firstErr = ctx.Err()
+	}
+	return firstErr
+}
+
+func (w *stateWalker) work(ctx context.Context) error {
+	for {
+		it := w.next(ctx)
+		if it == nil {
+			return ctx.Err()
+		}
+		var err error
+		if it.owner == nil {
+			err = w.walkState(ctx, it)
+		} else {
+			err = w.walkStorageRange(ctx, it)
+		}
+		w.mtx.Lock()
+		w.running--
+		w.mtx.Unlock()
+		w.cond.Broadcast()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// next waits for a task, returning nil once there are none left and none being processed which
+// could add more, or once ctx is done. While waiting, the busiest worker is asked to split its range
+// to hand over the rest, unless enough splits are already pending for the idle workers.
+func (w *stateWalker) next(ctx context.Context) *trackedIterator {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	for len(w.tasks) == 0 && w.running > 0 && ctx.Err() == nil {
+		w.idle++
+		if w.tracker.PendingSplits() < w.idle {
+			w.tracker.RequestSplit()
+		}
+		w.cond.Wait()
+		w.idle--
+	}
+	if len(w.tasks) == 0 || ctx.Err() != nil {
+		return nil
+	}
+	it := w.tasks[0]
+	w.tasks = w.tasks[1:]
+	w.running++
+	return it
+}
+
+func (w *stateWalker) add(its ...*trackedIterator) {
+	w.mtx.Lock()
+	w.tasks = append(w.tasks, its...)
+	w.mtx.Unlock()
+	w.cond.Broadcast()
+}
+
+// walkState emits the nodes of a range of the state trie.
+func (w *stateWalker) walkState(ctx context.Context, it *trackedIterator) error {
+	// a resumed iterator is positioned below the parent of the first node it moves to
+	prevBlob := it.NodeBlob()
+	for it.Next(true) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		// ignore node if it is not along paths of interest
+		if !isWatchedPathPrefix(w.watched, it.Path()) {
+			continue
+		}
+		if it.Leaf() {
+			account, err := decodeStateLeaf(it, prevBlob)
+			if err != nil {
+				return err
+			}
+			if err = w.processAccount(ctx, account); err != nil {
+				return err
+			}
+			continue
+		}
+		// embedded nodes are part of their parent's blob
+		if it.Hash() == (common.Hash{}) {
+			continue
+		}
+		nodeVal := bytes.Clone(it.NodeBlob())
+		// if doing a selective snapshot, we need to ensure this is a watched path
+		if len(w.watched) > 0 {
+			var elements []interface{}
+			if err := rlp.DecodeBytes(nodeVal, &elements); err != nil {
+				return err
+			}
+			ok, err := isLeaf(elements)
+			if err != nil {
+				return err
+			}
+			if ok {
+				valueNodePath := append(it.Path(), utils.CompactToHex(elements[0].([]byte))...)
+				if !isWatchedPath(w.watched, valueNodePath) {
+					continue
+				}
+			}
+		}
+		if err := w.ipldSink(sdtypes.IPLD{
+			CID:     ipld.Keccak256ToCid(ipld.MEthStateTrie, it.Hash().Bytes()).String(),
+			Content: nodeVal,
+		}); err != nil {
+			return err
+		}
+		prevBlob = nodeVal
+	}
+	return it.Error()
+}
+
+// processAccount emits an account with its storage and code. If its storage trie is divided, the
+// account is emitted without storage, and the ranges are added as tasks which emit the storage.
+func (w *stateWalker) processAccount(ctx context.Context, account *sdtypes.AccountWrapper) error {
+	node := sdtypes.StateLeafNode{AccountWrapper: *account}
+	if bytes.Equal(account.Account.CodeHash, emptyCodeHash) {
+		return w.nodeSink(node)
+	}
+	var ranges []*trackedIterator
+	// the rest of a restored account's storage is emitted by its restored ranges
+	if account.Account.Root != emptyContractRoot && !w.restored[string(account.LeafKey)] {
+		storage, err := w.openStorageTrie(account)
+		if err != nil {
+			return err
+		}
+		if ranges, err = w.splitStorage(storage, account); err != nil {
+			return err
+		}
+		if ranges == nil {
+			it, err := storage.NodeIterator(nil)
+			if err != nil {
+				return fmt.Errorf("error creating iterator for storage trie with root %s: %w", account.Account.Root, err)
+			}
+			err = w.walkStorage(ctx, it, func(leaf sdtypes.StorageLeafNode) error {
+				node.StorageDiff = append(node.StorageDiff, leaf)
+				return nil
+			})
+			if err != nil {
+				return fmt.Errorf("failed to walk storage of account %x: %w", account.LeafKey, err)
+			}
+		}
+	}
+	codeHash := common.BytesToHash(account.Account.CodeHash)
+	code, err := w.service.stateDB.ContractCode(common.Address{}, codeHash)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve code for codehash %s: %w", codeHash, err)
+	}
+	if err = w.ipldSink(sdtypes.IPLD{
+		CID:     ipld.Keccak256ToCid(ipld.RawBinary, codeHash.Bytes()).String(),
+		Content: code,
+	}); err != nil {
+		return err
+	}
+	// the account goes to the sink before its ranges can emit any storage
+	if err = w.nodeSink(node); err != nil {
+		return err
+	}
+	if len(ranges) != 0 {
+		w.add(ranges...)
+	}
+	return nil
+}
+
+func (w *stateWalker) openStorageTrie(account *sdtypes.AccountWrapper) (*trie.StateTrie, error) {
+	id := trie.StorageTrieID(w.root, common.BytesToHash(account.LeafKey), account.Account.Root)
+	storage, err := trie.NewStateTrie(id, w.service.stateDB.TrieDB())
+	if err != nil {
+		return nil, fmt.Errorf("error opening storage trie for root %s: %w", account.Account.Root, err)
+	}
+	return storage, nil
+}
+
+// openStorage opens the storage trie of an account to resume the walk of one of its ranges.
+func (w *stateWalker) openStorage(leafKey []byte, cid string) (*sdtypes.AccountWrapper, iter.IteratorConstructor, error) {
+	if w.storageSink == nil {
+		return nil, nil, fmt.Errorf("cannot resume divided storage trie of account %x: "+
+			"indexer cannot write storage nodes apart from their account", leafKey)
+	}
+	account, err := w.tree.GetAccountByHash(common.BytesToHash(leafKey))
+	if err != nil {
+		return nil, nil, err
+	}
+	if account == nil {
+		return nil, nil, fmt.Errorf("account %x not found in state trie", leafKey)
+	}
+	owner := &sdtypes.AccountWrapper{LeafKey: leafKey, Account: account, CID: cid}
+	storage, err := w.openStorageTrie(owner)
+	if err != nil {
+		return nil, nil, err
+	}
+	w.restored[string(leafKey)] = true
+	return owner, storage.NodeIterator, nil
+}
+
+// splitStorage divides the storage trie into tracked ranges, if it is estimated to hold more slots
+// than the threshold. It returns nil if the trie is not divided.
+func (w *stateWalker) splitStorage(
+	storage *trie.StateTrie, account *sdtypes.AccountWrapper,
+) ([]*trackedIterator, error) {
+	threshold := w.service.storageSplit
+	if threshold == 0 || w.workers < 2 || w.storageSink == nil {
+		return nil, nil
+	}
+	sample, err := sampleTrie(storage, nil, storageSampleSize, func([]byte, []byte) error { return nil })
+	if err != nil {
+		return nil, err
+	}
+	slots := sample.leaves
+	if slots == storageSampleSize {
+		slots = extrapolate(slots, sample.span, 1)
+	}
+	if slots <= threshold {
+		return nil, nil
+	}
+	// ranges are cut at uniform prefixes, so their number must be a power of two
+	ranges := uint(1) << (bits.Len(w.workers) - 1)
+	log.WithField("account", common.BytesToHash(account.LeafKey)).WithField("slots", slots).
+		WithField("ranges", ranges).Info("Dividing storage trie")
+	iters, err := iter.SubtrieIterators(storage.NodeIterator, ranges)
+	if err != nil {
+		return nil, fmt.Errorf("error creating subtrie iterators for storage trie: %w", err)
+	}
+	return w.tracker.TrackedStorage(iters, storage.NodeIterator, account), nil
+}
+
+// walkStorageRange emits the storage nodes of a range of a divided storage trie to the storage
+// sink, in chunks. The range's position is moved as each chunk is emitted, so chunks are no larger
+// than the commit interval.
+func (w *stateWalker) walkStorageRange(ctx context.Context, it *trackedIterator) error {
+	chunkSize := storageChunkSize
+	if interval := int(w.service.commitInterval); interval != 0 && interval < chunkSize {
+		chunkSize = interval
+	}
+	var chunk []sdtypes.StorageLeafNode
+	err := w.walkStorage(ctx, it, func(leaf sdtypes.StorageLeafNode) error {
+		chunk = append(chunk, leaf)
+		if len(chunk) < chunkSize {
+			return nil
+		}
+		if err := w.storageSink(it.owner.LeafKey, chunk); err != nil {
+			return err
+		}
+		// the range resumes after the chunk's last leaf, which is not written again. The last key
+		// of the trie has nothing after it, so the position is left where it was.
+		if next := pathAfterLeaf(it.Path()); next != nil {
+			it.setPosition(next)
+		}
+		chunk = nil
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to walk storage of account %x: %w", it.owner.LeafKey, err)
+	}
+	if len(chunk) != 0 {
+		if err = w.storageSink(it.owner.LeafKey, chunk); err != nil {
+			return err
+		}
+	}
+	it.finish()
+	return nil
+}
+
+// pathAfterLeaf returns the path of the key following that of the leaf at path, or nil if the leaf
+// has the last key.
+func pathAfterLeaf(path []byte) []byte {
+	next := bytes.Clone(path)
+	if len(next) != 0 && next[len(next)-1] == 0x10 {
+		next = next[:len(next)-1]
+	}
+	for i := len(next) - 1; i >= 0; i-- {
+		if next[i] < 0xf {
+			next[i]++
+			return next
+		}
+		next[i] = 0
+	}
+	return nil
+}
+
+// walkStorage emits the nodes of a storage trie, passing its leaves to onLeaf.
+func (w *stateWalker) walkStorage(
+	ctx context.Context, it trie.NodeIterator, onLeaf func(sdtypes.StorageLeafNode) error,
+) error {
+	prevBlob := it.NodeBlob()
+	for it.Next(true) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if it.Leaf() {
+			if err := onLeaf(decodeStorageLeaf(it, prevBlob)); err != nil {
+				return err
+			}
+			continue
+		}
+		// embedded nodes are part of their parent's blob
+		if it.Hash() == (common.Hash{}) {
+			continue
+		}
+		nodeVal := bytes.Clone(it.NodeBlob())
+		if err := w.ipldSink(sdtypes.IPLD{
+			CID:     ipld.Keccak256ToCid(ipld.MEthStorageTrie, it.Hash().Bytes()).String(),
+			Content: nodeVal,
+		}); err != nil {
+			return err
+		}
+		prevBlob = nodeVal
+	}
+	return it.Error()
+}
+
+// decodeStateLeaf decodes the account at a leaf. The leaf's RLP is its parent's blob.
+func decodeStateLeaf(it trie.NodeIterator, parentBlob []byte) (*sdtypes.AccountWrapper, error) {
+	var account types.StateAccount
+	if err := rlp.DecodeBytes(it.LeafBlob(), &account); err != nil {
+		return nil, fmt.Errorf("error decoding account at leaf key %x: %w", it.LeafKey(), err)
+	}
+	return &sdtypes.AccountWrapper{
+		LeafKey: bytes.Clone(it.LeafKey()),
+		Account: &account,
+		CID:     ipld.Keccak256ToCid(ipld.MEthStateTrie, crypto.Keccak256(parentBlob)).String(),
+	}, nil
+}
+
+func decodeStorageLeaf(it trie.NodeIterator, parentBlob []byte) sdtypes.StorageLeafNode {
+	return sdtypes.StorageLeafNode{
+		LeafKey: bytes.Clone(it.LeafKey()),
+		Value:   bytes.Clone(it.LeafBlob()),
+		CID:     ipld.Keccak256ToCid(ipld.MEthStorageTrie, crypto.Keccak256(parentBlob)).String(),
+	}
+}
+
+// isWatchedPathPrefix reports whether a path is along the path to a watched leaf. An empty watch
+// list means all paths are watched.
+func isWatchedPathPrefix(watchedLeafPaths [][]byte, path []byte) bool {
+	if len(watchedLeafPaths) == 0 {
+		return true
+	}
+	for _, watched := range watchedLeafPaths {
+		if bytes.HasPrefix(watched, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// isWatchedPath reports whether a path is that of a watched leaf.
+func isWatchedPath(watchedLeafPaths [][]byte, leafPath []byte) bool {
+	for _, watched := range watchedLeafPaths {
+		if bytes.Equal(watched, leafPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// isLeaf reports whether the decoded elements of a node are those of a leaf.
+func isLeaf(elements []interface{}) (bool, error) {
+	if len(elements) > 2 {
+		return false, nil
+	}
+	if len(elements) < 2 {
+		return false, fmt.Errorf("node cannot be less than two elements in length")
+	}
+	switch elements[0].([]byte)[0] / 16 {
+	case '\x00', '\x01':
+		return false, nil
+	case '\x02', '\x03':
+		return true, nil
+	default:
+		return false, fmt.Errorf("unknown hex prefix")
+	}
+}
@@ -0,0 +1,182 @@
+package snapshot_test
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/cerc-io/eth-iterator-utils/tracker"
+	"github.com/cerc-io/eth-testing/chains"
+	statediff "github.com/cerc-io/plugeth-statediff"
+	"github.com/cerc-io/plugeth-statediff/adapt"
+	"github.com/cerc-io/plugeth-statediff/indexer/ipld"
+	sdtypes "github.com/cerc-io/plugeth-statediff/types"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/trie"
+	"github.com/ethereum/go-ethereum/trie/trienode"
+	"github.com/ethereum/go-ethereum/triedb"
+	"github.com/holiman/uint256"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cerc-io/ipld-eth-state-snapshot/internal/mocks"
+	. "github.com/cerc-io/ipld-eth-state-snapshot/pkg/snapshot"
+	fixture "github.com/cerc-io/ipld-eth-state-snapshot/test"
+)
+
+// inlinedStorageState writes a state holding a contract whose storage slots differ only in their
+// last nibble and hold single byte values, so that the storage leaves, and the branch holding them,
+// are small enough to be embedded in their parents.
+func inlinedStorageState(t *testing.T) (ethdb.Database, common.Hash) {
+	db := rawdb.NewMemoryDatabase()
+	tdb := triedb.NewDatabase(db, nil)
+	addr := common.HexToAddress("0x1234")
+	code := []byte{0x60, 0x00}
+	codeHash := crypto.Keccak256Hash(code)
+	rawdb.WriteCode(db, codeHash, code)
+
+	storageID := trie.StorageTrieID(types.EmptyRootHash, crypto.Keccak256Hash(addr[:]), types.EmptyRootHash)
+	storage, err := trie.New(storageID, tdb)
+	require.NoError(t, err)
+	for i := byte(1); i <= 3; i++ {
+		key := make([]byte, common.HashLength)
+		key[len(key)-1] = i
+		storage.MustUpdate(key, []byte{i})
+	}
+	storageRoot, storageNodes, err := storage.Commit(false)
+	require.NoError(t, err)
+
+	state, err := trie.NewStateTrie(trie.StateTrieID(types.EmptyRootHash), tdb)
+	require.NoError(t, err)
+	require.NoError(t, state.UpdateAccount(addr, &types.StateAccount{
+		Nonce:    1,
+		Balance:  uint256.NewInt(0),
+		Root:     storageRoot,
+		CodeHash: codeHash.Bytes(),
+	}))
+	// the leaves are collected so that the storage trie is committed with the state trie
+	root, stateNodes, err := state.Commit(true)
+	require.NoError(t, err)
+
+	nodes := trienode.NewMergedNodeSet()
+	require.NoError(t, nodes.Merge(storageNodes))
+	require.NoError(t, nodes.Merge(stateNodes))
+	require.NoError(t, tdb.Update(root, types.EmptyRootHash, 0, nodes, nil))
+	require.NoError(t, tdb.Commit(root, false))
+	return db, root
+}
+
+func TestSnapshotInlinedStorage(t *testing.T) {
+	edb, root := inlinedStorageState(t)
+	idx := mocks.NewIndexer(t)
+	service, err := NewSnapshotService(edb, idx, filepath.Join(t.TempDir(), "recover.csv"))
+	require.NoError(t, err)
+	_, err = service.CreateSnapshot(context.Background(), SnapshotParams{StateRoot: root})
+	require.NoError(t, err)
+
+	cids := cidSet(idx.IndexerData)
+	// embedded nodes have no hash of their own, so must not be emitted
+	require.NotContains(t, cids, ipld.Keccak256ToCid(ipld.MEthStorageTrie, common.Hash{}.Bytes()).String())
+	require.Len(t, idx.StateNodes, 1)
+	storage := idx.StateNodes[0].StorageDiff
+	require.Len(t, storage, 3)
+	// each slot refers to the stored node which holds it
+	for _, slot := range storage {
+		require.Contains(t, cids, slot.CID)
+	}
+}
+
+// builderSnapshot writes the state at the given height with the statediff builder.
+func builderSnapshot(t *testing.T, edb ethdb.Database, height uint64) ([]sdtypes.StateLeafNode, []sdtypes.IPLD) {
+	header := rawdb.ReadHeader(edb, rawdb.ReadCanonicalHash(edb, height), height)
+	require.NotNil(t, header)
+	builder := statediff.NewBuilder(adapt.GethStateView(state.NewDatabase(edb)))
+
+	var mtx sync.Mutex
+	var nodes []sdtypes.StateLeafNode
+	var iplds []sdtypes.IPLD
+	nodeSink := func(node sdtypes.StateLeafNode) error {
+		mtx.Lock()
+		defer mtx.Unlock()
+		nodes = append(nodes, node)
+		return nil
+	}
+	ipldSink := func(c sdtypes.IPLD) error {
+		mtx.Lock()
+		defer mtx.Unlock()
+		iplds = append(iplds, c)
+		return nil
+	}
+	tr := tracker.New(filepath.Join(t.TempDir(), "builder-recover.csv"), 4)
+	defer tr.CloseAndSave()
+	err := builder.WriteStateSnapshot(context.Background(), header.Root, statediff.Params{}, nodeSink, ipldSink, tr)
+	require.NoError(t, err)
+	return nodes, iplds
+}
+
+// sortedRows orders state nodes, and the storage nodes of each, by leaf key.
+func sortedRows(nodes []sdtypes.StateLeafNode) []sdtypes.StateLeafNode {
+	rows := append([]sdtypes.StateLeafNode(nil), nodes...)
+	for i := range rows {
+		storage := append([]sdtypes.StorageLeafNode(nil), rows[i].StorageDiff...)
+		sort.Slice(storage, func(a, b int) bool {
+			return bytes.Compare(storage[a].LeafKey, storage[b].LeafKey) < 0
+		})
+		rows[i].StorageDiff = storage
+	}
+	sort.Slice(rows, func(a, b int) bool {
+		return bytes.Compare(rows[a].AccountWrapper.LeafKey, rows[b].AccountWrapper.LeafKey) < 0
+	})
+	return rows
+}
+
+func ipldContents(iplds []sdtypes.IPLD) map[string][]byte {
+	contents := make(map[string][]byte)
+	for _, c := range iplds {
+		contents[c.CID] = c.Content
+	}
+	return contents
+}
+
+// The state walker follows the traversal of the statediff builder, so that it can divide storage
+// tries and save its positions while running. Its rows must be those the builder would write.
+func TestWalkerMatchesBuilder(t *testing.T) {
+	cases := []struct {
+		name   string
+		chain  *chains.Paths
+		height uint64
+	}{
+		{"chain A at 1", fixture.ChainA, 1},
+		{"chain A at 262", fixture.ChainA, 262},
+		{"chain B at 32", fixture.ChainB, 32},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			edb := openEthDB(t, tc.chain)
+			expectedNodes, expectedIPLDs := builderSnapshot(t, edb, tc.height)
+
+			for _, split := range []uint64{0, 1} {
+				idx := mocks.NewIndexer(t)
+				service, err := NewSnapshotService(edb, idx, filepath.Join(t.TempDir(), "recover.csv"))
+				require.NoError(t, err)
+				service.SetStorageSplit(split)
+				_, err = service.CreateSnapshot(context.Background(), SnapshotParams{Height: tc.height, Workers: 4})
+				require.NoError(t, err)
+
+				expected, actual := sortedRows(expectedNodes), sortedRows(idx.StateNodes)
+				require.Len(t, actual, len(expected))
+				for i := range expected {
+					require.Equal(t, expected[i], actual[i], "state node %x", expected[i].AccountWrapper.LeafKey)
+				}
+				require.Equal(t, ipldContents(expectedIPLDs), ipldContents(idx.IPLDs))
+			}
+		})
+	}
+}